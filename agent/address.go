@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// interfaceAddrs is the subset of a network interface's state used to discover advertise addresses.
+type interfaceAddrs struct {
+	Name  string
+	Flags net.Flags
+	Addrs []net.Addr
+}
+
+// discoverAddresses returns the addresses the coordinator should use to reach this node, in order of preference.
+// Addresses are optionally restricted to a particular interface and/or CIDRs.
+func discoverAddresses(iface string, cidrs string) ([]string, error) {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	sysIfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("listing network interfaces: %w", err)
+	}
+	ifaces := make([]*interfaceAddrs, 0, len(sysIfaces))
+	for _, sysIface := range sysIfaces {
+		addrs, err := sysIface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("listing addresses of interface %q: %w", sysIface.Name, err)
+		}
+		ifaces = append(ifaces, &interfaceAddrs{Name: sysIface.Name, Flags: sysIface.Flags, Addrs: addrs})
+	}
+
+	ips := filterAddresses(ifaces, iface, nets)
+	if len(ips) == 0 {
+		return nil, errors.New("no matching addresses were found - set --ip, --advertise-interface, or --advertise-cidr")
+	}
+	return ips, nil
+}
+
+// filterAddresses returns the global unicast addresses of interfaces that are up.
+// IPv4 addresses are preferred over IPv6, and addresses are ordered by the first matching CIDR when given.
+// Loopback interfaces are only considered when requested by name.
+func filterAddresses(ifaces []*interfaceAddrs, name string, cidrs []*net.IPNet) []string {
+	var v4, v6 []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if name != "" && iface.Name != name {
+			continue
+		}
+		if name == "" && iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		for _, addr := range iface.Addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipnet.IP
+			if !ip.IsGlobalUnicast() && !(name != "" && ip.IsLoopback()) {
+				continue
+			}
+			if ip.To4() != nil {
+				v4 = append(v4, ip)
+			} else {
+				v6 = append(v6, ip)
+			}
+		}
+	}
+	candidates := append(v4, v6...)
+
+	if len(cidrs) == 0 {
+		return formatIPs(candidates)
+	}
+	matches := []net.IP{}
+	for _, cidr := range cidrs {
+		for _, ip := range candidates {
+			if cidr.Contains(ip) {
+				matches = append(matches, ip)
+			}
+		}
+	}
+	return formatIPs(matches)
+}
+
+func parseCIDRs(str string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, chunk := range strings.Split(str, ",") {
+		chunk = strings.TrimSpace(chunk)
+		if chunk == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(chunk)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func formatIPs(ips []net.IP) []string {
+	strs := []string{}
+	seen := map[string]struct{}{}
+	for _, ip := range ips {
+		str := ip.String()
+		if _, ok := seen[str]; ok {
+			continue
+		}
+		seen[str] = struct{}{}
+		strs = append(strs, str)
+	}
+	return strs
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterAddresses(t *testing.T) {
+	ifaces := []*interfaceAddrs{
+		{Name: "lo", Flags: net.FlagUp | net.FlagLoopback, Addrs: []net.Addr{mustParseAddr(t, "127.0.0.1/8")}},
+		{Name: "eth0", Flags: net.FlagUp, Addrs: []net.Addr{mustParseAddr(t, "fd00::10/64"), mustParseAddr(t, "fe80::1/64"), mustParseAddr(t, "10.0.0.10/24")}},
+		{Name: "eth1", Flags: net.FlagUp, Addrs: []net.Addr{mustParseAddr(t, "192.168.1.10/24")}},
+		{Name: "eth2", Addrs: []net.Addr{mustParseAddr(t, "172.16.0.10/24")}}, // down
+	}
+
+	t.Run("all", func(t *testing.T) {
+		assert.Equal(t, []string{"10.0.0.10", "192.168.1.10", "fd00::10"}, filterAddresses(ifaces, "", nil))
+	})
+
+	t.Run("interface", func(t *testing.T) {
+		assert.Equal(t, []string{"10.0.0.10", "fd00::10"}, filterAddresses(ifaces, "eth0", nil))
+		assert.Equal(t, []string{"127.0.0.1"}, filterAddresses(ifaces, "lo", nil))
+		assert.Empty(t, filterAddresses(ifaces, "eth2", nil))
+	})
+
+	t.Run("cidr", func(t *testing.T) {
+		cidrs, err := parseCIDRs("fd00::/8, 192.168.0.0/16")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"fd00::10", "192.168.1.10"}, filterAddresses(ifaces, "", cidrs))
+	})
+
+	t.Run("invalid cidr", func(t *testing.T) {
+		_, err := parseCIDRs("nope")
+		assert.Error(t, err)
+	})
+}
+
+func mustParseAddr(t *testing.T, cidr string) net.Addr {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+	ipnet.IP = ip
+	return ipnet
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jveski/recompose/internal/api"
+)
+
+// containerBaseline is the live config of a container recorded right after the agent created it.
+// Later differences between the live config and the baseline mean the container was changed outside of recompose
+// i.e. by `podman update`. Containers are always expected to be running, regardless of their state when recorded.
+type containerBaseline struct {
+	Config map[string]string
+}
+
+type inspectOutput struct {
+	Name   string
+	Image  string // ID
+	Config struct {
+		Image string
+		Cmd   []string
+		Env   []string
+	}
+	HostConfig struct {
+		Memory, NanoCpus, CpuQuota, CpuShares, PidsLimit int64
+		RestartPolicy                                    struct{ Name string }
+	}
+	State struct {
+		Status                      string
+		Running, Paused, Restarting bool
+		Health                      struct{ Status string }
+	}
+}
+
+// podmanInspect returns the inspect output of the given containers, keyed by name.
+func podmanInspect(names ...string) (map[string]*inspectOutput, error) {
+	index := map[string]*inspectOutput{}
+	if len(names) == 0 {
+		return index, nil
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(runtimeCmd, append([]string{"inspect", "--type=container"}, names...)...)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil && !onlyMissingContainers(stderr.String()) {
+		return nil, fmt.Errorf("%s", stderr)
+	}
+
+	// Containers removed since `podman ps` ran are left out of the output (and the index)
+	list := []*inspectOutput{}
+	if err := json.Unmarshal(out, &list); err != nil && len(bytes.TrimSpace(out)) > 0 {
+		return nil, fmt.Errorf("decoding 'inspect' command's output: %w", err)
+	}
+	for _, item := range list {
+		index[strings.TrimPrefix(item.Name, "/")] = item // docker prefixes names with a slash
+	}
+	return index, nil
+}
+
+// onlyMissingContainers returns true when every error written by `inspect` is about a container that doesn't exist.
+func onlyMissingContainers(stderr string) bool {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	for _, line := range lines {
+		if !strings.Contains(strings.ToLower(line), "no such") {
+			return false
+		}
+	}
+	return len(lines) > 0 && lines[0] != ""
+}
+
+func newBaseline(live *inspectOutput) *containerBaseline {
+	env := append([]string{}, live.Config.Env...)
+	sort.Strings(env)
+	envHash := sha256.Sum256([]byte(strings.Join(env, "\n"))) // env vars include decrypted secrets
+
+	return &containerBaseline{
+		Config: map[string]string{
+			"image":         live.Image,
+			"imageName":     live.Config.Image,
+			"command":       strings.Join(live.Config.Cmd, " "),
+			"env":           hex.EncodeToString(envHash[:]),
+			"memory":        strconv.FormatInt(live.HostConfig.Memory, 10),
+			"cpus":          strconv.FormatInt(live.HostConfig.NanoCpus, 10),
+			"cpuQuota":      strconv.FormatInt(live.HostConfig.CpuQuota, 10),
+			"cpuShares":     strconv.FormatInt(live.HostConfig.CpuShares, 10),
+			"pidsLimit":     strconv.FormatInt(live.HostConfig.PidsLimit, 10),
+			"restartPolicy": live.HostConfig.RestartPolicy.Name,
+		},
+	}
+}
+
+// detectDrift describes how the live container differs from its baseline, or returns an empty string if it doesn't.
+func detectDrift(baseline *containerBaseline, live *inspectOutput) string {
+	current := newBaseline(live)
+
+	keys := make([]string, 0, len(baseline.Config))
+	for key := range baseline.Config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	diffs := []string{}
+	for _, key := range keys {
+		prev, cur := baseline.Config[key], current.Config[key]
+		switch {
+		case prev == cur:
+		case key == "env":
+			diffs = append(diffs, "env changed")
+		default:
+			diffs = append(diffs, fmt.Sprintf("%s changed from %q to %q", key, prev, cur))
+		}
+	}
+
+	switch {
+	case live.State.Paused:
+		diffs = append(diffs, "container is paused")
+	case !live.State.Running && !live.State.Restarting:
+		diffs = append(diffs, fmt.Sprintf("container is %s, expected running", live.State.Status))
+	}
+
+	return strings.Join(diffs, "; ")
+}
+
+// checkDrift compares the live container to its baseline.
+// Containers created before drift detection was enabled are adopted by recording their current config as the baseline,
+// although they're still expected to be running.
+func checkDrift(hash string, live *inspectOutput) (string, error) {
+	if live == nil {
+		return "", nil // removed since `podman ps` ran
+	}
+
+	baseline, err := readBaseline("baseline", hash)
+	if err != nil {
+		return "", err
+	}
+	if baseline == nil {
+		baseline = newBaseline(live)
+		if err := writeBaseline("baseline", hash, baseline); err != nil {
+			return "", err
+		}
+	}
+	return detectDrift(baseline, live), nil
+}
+
+// recordBaseline stores the live config of a container the agent just created.
+func recordBaseline(spec *api.ContainerSpec) error {
+	live, err := podmanInspect(spec.Name)
+	if err != nil {
+		return err
+	}
+	if live[spec.Name] == nil {
+		return fmt.Errorf("container not found")
+	}
+	return writeBaseline("baseline", spec.Hash, newBaseline(live[spec.Name]))
+}
+
+func readBaseline(dir, hash string) (*containerBaseline, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, hash+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	baseline := &containerBaseline{}
+	return baseline, json.Unmarshal(buf, baseline)
+}
+
+func writeBaseline(dir, hash string, baseline *containerBaseline) error {
+	buf, err := json.Marshal(baseline)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, hash+".json"), buf, 0644)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testInspectOutput = `{
+	"Name": "test",
+	"Image": "test-image-id",
+	"Config": {"Image": "docker.io/library/nginx:latest", "Cmd": ["nginx", "-g", "daemon off;"], "Env": ["B=2", "A=1"]},
+	"HostConfig": {"Memory": 0, "NanoCpus": 0, "PidsLimit": 2048, "RestartPolicy": {"Name": "always"}},
+	"State": {"Status": "running", "Running": true}
+}`
+
+func TestDetectDrift(t *testing.T) {
+	parse := func() *inspectOutput {
+		live := &inspectOutput{}
+		require.NoError(t, json.Unmarshal([]byte(testInspectOutput), live))
+		return live
+	}
+	baseline := newBaseline(parse())
+
+	t.Run("no drift", func(t *testing.T) {
+		live := parse()
+		live.Config.Env = []string{"A=1", "B=2"} // order doesn't matter
+		assert.Empty(t, detectDrift(baseline, live))
+	})
+
+	t.Run("updated", func(t *testing.T) {
+		live := parse()
+		live.HostConfig.Memory = 1024
+		live.Config.Env = append(live.Config.Env, "C=3")
+		assert.Equal(t, `env changed; memory changed from "0" to "1024"`, detectDrift(baseline, live))
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		live := parse()
+		live.State.Running = false
+		live.State.Status = "exited"
+		assert.Equal(t, "container is exited, expected running", detectDrift(baseline, live))
+
+		live.State.Restarting = true
+		assert.Empty(t, detectDrift(baseline, live))
+	})
+
+	t.Run("stopped when recorded", func(t *testing.T) {
+		live := parse()
+		live.State.Running = false
+		live.State.Status = "exited"
+		assert.Equal(t, "container is exited, expected running", detectDrift(newBaseline(live), live))
+	})
+
+	t.Run("paused", func(t *testing.T) {
+		live := parse()
+		live.State.Paused = true
+		assert.Equal(t, "container is paused", detectDrift(baseline, live))
+	})
+
+	t.Run("image replaced", func(t *testing.T) {
+		live := parse()
+		live.Image = "other-image-id"
+		assert.Equal(t, `image changed from "test-image-id" to "other-image-id"`, detectDrift(baseline, live))
+	})
+}
+
+func TestPodmanInspectMissingContainer(t *testing.T) {
+	setFakeRuntime(t, `echo '[`+strings.ReplaceAll(testInspectOutput, "\n", "")+`]'; echo "Error: no such container missing" >&2; exit 125`)
+
+	live, err := podmanInspect("test", "missing")
+	require.NoError(t, err)
+	assert.NotNil(t, live["test"])
+	assert.Nil(t, live["missing"])
+
+	setFakeRuntime(t, `echo "Error: permission denied" >&2; exit 125`)
+	_, err = podmanInspect("test")
+	assert.EqualError(t, err, "Error: permission denied\n")
+}
+
+// setFakeRuntime replaces the container runtime with a shell script for the duration of the test.
+func setFakeRuntime(t *testing.T, script string) {
+	path := filepath.Join(t.TempDir(), "runtime")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755))
+
+	prev := runtimeCmd
+	runtimeCmd = path
+	t.Cleanup(func() { runtimeCmd = prev })
+}
+
+func TestBaselineRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	actual, err := readBaseline(dir, "test-hash")
+	require.NoError(t, err)
+	assert.Nil(t, actual)
+
+	expected := &containerBaseline{Config: map[string]string{"image": "test"}}
+	require.NoError(t, writeBaseline(dir, "test-hash", expected))
+
+	actual, err = readBaseline(dir, "test-hash")
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/csv"
 	"errors"
@@ -11,10 +12,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/julienschmidt/httprouter"
 	"github.com/jveski/recompose/internal/concurrency"
 	"github.com/jveski/recompose/internal/rpc"
@@ -67,9 +70,9 @@ func newApiHandler(auth rpc.Authorizer) http.Handler {
 			hash := strings.TrimSuffix(file.Name(), ".txt")
 			ps := psByHash[hash]
 			if ps != nil {
-				spl = append(spl, strconv.FormatInt(ps.Created, 10), strconv.FormatInt(ps.StartedAt, 10))
+				spl = append(spl, strconv.FormatInt(ps.Created, 10), strconv.FormatInt(ps.StartedAt, 10), ps.Image)
 			} else {
-				spl = append(spl, "", "") // maintain expected number of rows
+				spl = append(spl, "", "", "") // maintain expected number of rows
 			}
 
 			cw.Write(spl)
@@ -96,10 +99,16 @@ func newApiHandler(auth rpc.Authorizer) http.Handler {
 	return router
 }
 
-func register(client *coordClient, ip string, port uint) error {
+func register(client *coordClient, ips []string, port uint, trusts []string) error {
 	form := url.Values{}
-	form.Add("ip", ip)
+	for _, ip := range ips {
+		form.Add("ip", ip)
+	}
 	form.Add("apiport", strconv.Itoa(int(port)))
+	form.Add("platform", runtime.GOOS+"/"+runtime.GOARCH) // images served by the coordinator are pulled for this platform
+	for _, fingerprint := range trusts {
+		form.Add("trusts", fingerprint)
+	}
 
 	// time out the long polling connection after a reasonable period
 	ctx, done := context.WithTimeout(context.Background(), concurrency.Jitter(time.Minute*15))
@@ -117,3 +126,41 @@ func register(client *coordClient, ip string, port uint) error {
 	io.Copy(io.Discard, resp.Body)
 	return nil
 }
+
+// enroll asks the coordinator to add this node to the list of nodes pending approval.
+func enroll(client *coordClient, ips []string, joinToken string) error {
+	buf := &bytes.Buffer{}
+	if err := toml.NewEncoder(buf).Encode(getFacts()); err != nil {
+		return err
+	}
+
+	ctx, done := context.WithTimeout(context.Background(), time.Minute)
+	defer done()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", client.BaseURL+"/enroll?"+url.Values{"ip": ips}.Encode(), buf)
+	if err != nil {
+		return err
+	}
+	if joinToken != "" {
+		req.Header.Set("Authorization", "Bearer "+joinToken)
+	}
+
+	resp, err := client.Send(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// getFacts returns information about the node that helps operators decide whether to approve it.
+func getFacts() map[string]string {
+	facts := map[string]string{"os": runtime.GOOS, "arch": runtime.GOARCH}
+	if hostname, err := os.Hostname(); err == nil {
+		facts["hostname"] = hostname
+	}
+	if kernel, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		facts["kernel"] = strings.TrimSpace(string(kernel))
+	}
+	return facts
+}
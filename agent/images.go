@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/inventory"
+)
+
+// imageFetcher downloads the archive of an image pinned to the given digest.
+type imageFetcher interface {
+	FetchImage(digest string, w io.Writer) error
+}
+
+// FetchImage downloads the image's archive from the coordinator, which is useful for nodes without registry access.
+func (c *coordClient) FetchImage(digest string, w io.Writer) error {
+	resp, err := c.GET(context.Background(), c.BaseURL+"/images/"+digest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// localImageRef returns the reference an image archive is loaded as.
+// Loaded archives don't keep their registry digest, so they're tagged with it instead.
+func localImageRef(digest string) string {
+	return "localhost/recompose:" + strings.Replace(digest, ":", "-", 1)
+}
+
+// loadImage makes sure the container's image has been loaded from an archive fetched using the given fetcher.
+// Returns a copy of the spec referencing the loaded image.
+func loadImage(fetcher imageFetcher, spec *api.ContainerSpec) (*api.ContainerSpec, error) {
+	digest := spec.ImageDigest
+	if digest == "" {
+		digest = inventory.ParseImage(spec.Image).Digest
+	}
+	if digest == "" {
+		return nil, errors.New(`only images pinned to a digest (or tracked using image_policy = "track") can be loaded from the coordinator`)
+	}
+
+	local := *spec
+	local.Image = localImageRef(digest)
+	local.ImageDigest = ""
+	if podmanImageExists(local.Image) {
+		return &local, nil // already loaded
+	}
+
+	log.Printf("loading image %q for container %q...", spec.Image, spec.Name)
+	writeState(spec.Name, spec.Hash, "Pulling", "")
+
+	f, err := os.CreateTemp("", "recompose-image-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := fetcher.FetchImage(digest, f); err != nil {
+		return nil, fmt.Errorf("fetching image archive: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	out, err := exec.Command(runtimeCmd, "load", "--input", f.Name()).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("loading image archive: %s", out)
+	}
+	loaded := parseLoadOutput(string(out))
+	if loaded == "" {
+		return nil, fmt.Errorf("unexpected output while loading image archive: %s", out)
+	}
+	if out, err := exec.Command(runtimeCmd, "tag", loaded, local.Image).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("tagging loaded image: %s", out)
+	}
+
+	log.Printf("loaded image %q", spec.Image)
+	return &local, nil
+}
+
+// parseLoadOutput returns the reference (or ID) of the first image loaded by `podman load` or `docker load`
+// i.e. "Loaded image: sha256:..." or "Loaded image(s): localhost/app:latest".
+func parseLoadOutput(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "Loaded image") {
+			continue
+		}
+		_, refs, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		ref, _, _ := strings.Cut(strings.TrimSpace(refs), ",")
+		return ref
+	}
+	return ""
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jveski/recompose/internal/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLoadOutput(t *testing.T) {
+	assert.Equal(t, "sha256:abc", parseLoadOutput("Getting image source signatures\nLoaded image: sha256:abc\n"))
+	assert.Equal(t, "localhost/a:latest", parseLoadOutput("Loaded image(s): localhost/a:latest,localhost/b:latest\n"))
+	assert.Equal(t, "sha256:abc", parseLoadOutput("Loaded image ID: sha256:abc\n"))
+	assert.Empty(t, parseLoadOutput("something else"))
+}
+
+func TestLoadImageRequiresDigest(t *testing.T) {
+	_, err := loadImage(nil, &api.ContainerSpec{Image: "nginx:latest"})
+	assert.EqualError(t, err, `only images pinned to a digest (or tracked using image_policy = "track") can be loaded from the coordinator`)
+	assert.Equal(t, "localhost/recompose:sha256-abc", localImageRef("sha256:abc"))
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/jveski/recompose/internal/api"
@@ -18,44 +21,167 @@ import (
 func main() {
 	var (
 		coordinatorAddr        = flag.String("coordinator", "", "host or host:port of the coordination server")
-		coordinatorFingerprint = flag.String("coordinator-fingerprint", "", "fingerprint of the coordination server's certificate")
-		ip                     = flag.String("ip", "", "optionally override IP used to reach this process from the coordinator")
-		port                   = flag.Uint("addr", 8234, "port to serve the agent API on. 0 to disable")
+		coordinatorFingerprint = flag.String("coordinator-fingerprint", "", "fingerprint of the coordination server's certificate. Separate multiple fingerprints with commas while the coordinator is rotating its cert")
+		ip                     = flag.String("ip", "", "optionally override the IP(s) used to reach this process from the coordinator. Separate multiple addresses with commas, in order of preference. Standalone agents only use it for {{ node.ip }}")
+		advertiseInterface     = flag.String("advertise-interface", "", "(optional) only advertise addresses of this network interface")
+		advertiseCIDR          = flag.String("advertise-cidr", "", "(optional) only advertise addresses within these comma-separated CIDRs, in order of preference")
+		port                   = flag.Uint("addr", 8234, "port to serve the agent API on. 0 to only serve it over tunnels opened to the coordinator")
+		coordinatorCA          = flag.String("coordinator-ca", "", "(optional) PEM bundle of CAs trusted to issue the coordinator's cert. Requires --coordinator-name")
+		coordinatorName        = flag.String("coordinator-name", "", "name (DNS SAN or CN) of the coordinator's CA-issued cert")
+		tlsCert                = flag.String("tls-cert", "", "(optional) use this cert i.e. one issued by a CA, rather than a generated self-signed cert")
+		tlsKey                 = flag.String("tls-key", "", "private key of --tls-cert")
+		rotateCert             = flag.Bool("rotate-cert", false, "generate the next cert and exit. The running agent switches to it once the coordinator trusts its fingerprint")
+		joinToken              = flag.String("join-token", "", "(optional) token presented when enrolling with a coordinator that requires one")
+		inventoryDir           = flag.String("inventory-dir", "", "(optional) run without a coordinator, reading the inventory from this directory. It can hold a cluster.toml layout or the container files of this node")
+		nodeID                 = flag.String("node", "", "name or fingerprint of this node in the cluster.toml of --inventory-dir (defaults to the fingerprint of --tls-cert, hostname, or the only node)")
+		identity               = flag.String("identity", "", "age identity file used to decrypt secrets when using --inventory-dir")
+		enforce                = flag.Bool("enforce", false, "recreate containers that have drifted from their spec i.e. were stopped or updated by hand. Otherwise drift is only reported")
+		driftInterval          = flag.Duration("drift-check-interval", time.Minute*5, "how often to check containers for drift from their spec")
+		pullFromCoordinator    = flag.Bool("pull-from-coordinator", false, "load images from archives served by the coordinator rather than pulling them from their registry i.e. on nodes without registry access. Images must be pinned to a digest")
 	)
 	flag.Parse()
 
+	if *rotateCert {
+		_, fingerprint, err := rpc.GenNextCertificate(".")
+		if err != nil {
+			log.Fatalf("fatal error while generating next certificate: %s", err)
+		}
+		fmt.Printf("Generated the next certificate. Add its fingerprint to this node's `fingerprints` in cluster.toml to complete the rotation:\n\n%s\n", fingerprint)
+		return
+	}
+
 	var (
 		inventoryFile = filepath.Join(".", "inventory.toml")
 		state         = &concurrency.StateContainer[*api.NodeInventory]{}
 		client        = &coordClient{BaseURL: rpc.UrlPrefix(*coordinatorAddr)}
 	)
 
-	for _, dir := range []string{"mounts", "state"} {
+	for _, dir := range []string{"mounts", "state", "baseline"} {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			log.Fatalf("fatal error while creating directory %q: %s", dir, err)
 		}
 	}
 
-	cert, _, err := rpc.GenCertificate(".")
-	if err != nil {
-		log.Fatalf("fatal error while generating certificate: %s", err)
+	// Secrets are decrypted by the coordinator unless running standalone
+	var decrypter secretDecrypter = client
+	if *inventoryDir != "" {
+		decrypter = &localDecrypter{IdentityFile: *identity}
 	}
 
-	// The client used to access the coordinator API only trusts the known server cert fingerprint
-	coordAuth := rpc.TrustOneCert(*coordinatorFingerprint)
-	client.Client = rpc.NewClient(cert, time.Minute*45, coordAuth)
+	var fetcher imageFetcher
+	if *pullFromCoordinator {
+		if *inventoryDir != "" {
+			log.Fatalf("--pull-from-coordinator can't be used with --inventory-dir")
+		}
+		fetcher = client
+	}
+
+	ips := []string{}
+	for _, addr := range strings.Split(*ip, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			ips = append(ips, addr)
+		}
+	}
+	hostname, _ := os.Hostname()
+
+	// Podman is sync'd periodically (to detect drift) and when the inventory state changes
+	runPodman := func(node map[string]string) {
+		go concurrency.RunLoop(
+			state.Watch(context.Background()),
+			*driftInterval, time.Hour,
+			func() bool {
+				err := syncPodman(decrypter, fetcher, node, state, *enforce)
+				if err != nil {
+					log.Printf("error syncing podman: %s", err)
+				}
+				return err == nil
+			})
+	}
+
+	// Standalone agents read the inventory from disk whenever it changes, without a coordinator.
+	// They don't serve the agent API, so there's no cert to generate or addresses to advertise.
+	if *inventoryDir != "" {
+		var fingerprint string
+		if *tlsCert != "" {
+			var err error
+			if _, fingerprint, err = rpc.LoadCertificate(*tlsCert, *tlsKey); err != nil {
+				log.Fatalf("fatal error while loading certificate: %s", err)
+			}
+		}
+		node := map[string]string{"fingerprint": fingerprint, "hostname": hostname}
+		if len(ips) > 0 {
+			node["ip"] = ips[0]
+		}
+		runPodman(node)
 
-	// Podman is sync'd periodically and when the inventory state changes
-	go concurrency.RunLoop(
-		state.Watch(context.Background()),
-		time.Minute*30, time.Hour,
-		func() bool {
-			err := syncPodman(client, state)
+		changes, err := watchDir(*inventoryDir)
+		if err != nil {
+			log.Fatalf("fatal error while watching inventory directory: %s", err)
+		}
+		nodeIDs := []string{*nodeID, fingerprint, hostname}
+		concurrency.RunLoop(changes, time.Minute*5, time.Minute, func() bool {
+			err := syncLocalInventory(*inventoryDir, nodeIDs, state)
 			if err != nil {
-				log.Printf("error syncing podman: %s", err)
+				log.Printf("error reading inventory from disk: %s", err)
 			}
 			return err == nil
 		})
+		return
+	}
+
+	var (
+		cert        tls.Certificate
+		fingerprint string
+		err         error
+	)
+	if *tlsCert != "" {
+		cert, fingerprint, err = rpc.LoadCertificate(*tlsCert, *tlsKey)
+	} else {
+		cert, fingerprint, err = rpc.GenCertificate(".")
+	}
+	if err != nil {
+		log.Fatalf("fatal error while generating certificate: %s", err)
+	}
+
+	// Agents that only serve the API over tunnels (--addr=0) don't need an address to advertise,
+	// but templates can still use one when it's found.
+	if len(ips) == 0 {
+		ips, err = discoverAddresses(*advertiseInterface, *advertiseCIDR)
+		if err != nil && *port != 0 {
+			log.Fatalf("fatal error while discovering advertise addresses: %s", err)
+		}
+		if err != nil {
+			log.Printf("not advertising any addresses: %s", err)
+		}
+	}
+	node := map[string]string{"fingerprint": fingerprint, "hostname": hostname}
+	if len(ips) > 0 {
+		log.Printf("advertising addresses: %s", strings.Join(ips, ", "))
+		node["ip"] = ips[0]
+	}
+	runPodman(node)
+
+	// The client used to access the coordinator API only trusts the known server cert fingerprint(s),
+	// or a cert with the expected name issued by the coordinator's CA.
+	coordFingerprints := []string{}
+	for _, fingerprint := range strings.Split(*coordinatorFingerprint, ",") {
+		if fingerprint != "" {
+			coordFingerprints = append(coordFingerprints, fingerprint)
+		}
+	}
+	coordAuth := rpc.TrustCerts(coordFingerprints...)
+	if *coordinatorCA != "" {
+		if *coordinatorName == "" {
+			log.Fatalf("--coordinator-name is required when using --coordinator-ca")
+		}
+		ca, err := rpc.LoadCAAuthorizer(*coordinatorCA, "")
+		if err != nil {
+			log.Fatalf("fatal error while loading coordinator CA: %s", err)
+		}
+		ca.Names = rpc.TrustNames(*coordinatorName)
+		coordAuth = rpc.TrustAny(coordAuth, ca)
+	}
+	client.Client = rpc.NewClient(cert, time.Minute*45, coordAuth)
 
 	// The inventory is retrieved from the coordinator in a loop using long polling
 	go concurrency.RunLoop(nil, 0, time.Minute*15, func() bool {
@@ -70,17 +196,43 @@ func main() {
 	// The long polling approach allows them to more quickly re-register when coordinators become available
 	// while generating minimal request volume during steady state operation.
 	go concurrency.RunLoop(nil, 0, time.Minute, func() bool {
-		ip := *ip
-		if ip == "" {
-			ip = getOutboundIP().String()
+		err := register(client, ips, *port, coordFingerprints)
+		if ec := (&rpc.ErrUntrustedClient{}); errors.As(err, &ec) {
+			// Nodes that aren't in the inventory yet ask to join the cluster until they're approved
+			if err := enroll(client, ips, *joinToken); err != nil {
+				log.Printf("error enrolling with coordinator: %s", err)
+				return false
+			}
+			log.Printf("waiting for this node to be added to cluster.toml: %s", fingerprint)
+			return false
 		}
-		err := register(client, ip, *port)
 		if err != nil {
 			log.Printf("error registering node metadata with coordinator: %s", err)
 		}
 		return err == nil
 	})
 
+	// Cert rotations started by --rotate-cert are completed once the coordinator trusts the next cert
+	go concurrency.RunLoop(make(chan struct{}), time.Minute, time.Minute, func() bool {
+		err := completeCertRotation(client.BaseURL, coordAuth)
+		if err != nil {
+			log.Printf("error while rotating certificate: %s", err)
+		}
+		return err == nil
+	})
+
+	// The API is served over tunnels opened to the coordinator, which allows it to reach agents behind NAT or firewalls
+	tunnels := newTunnelListener(client.BaseURL+"/tunnel", client.Transport.(*http.Transport).TLSClientConfig, 2)
+	go func() {
+		if err := tunnels.Serve(rpc.WithLogging(newApiHandler(coordAuth))); err != nil {
+			log.Fatalf("fatal error while serving API over tunnels: %s", err)
+		}
+	}()
+
+	if *port == 0 {
+		select {} // only reachable over tunnels
+	}
+
 	// This server exposes information to the coordinator about the current state of containers managed by this agent.
 	svr := rpc.NewServer(
 		fmt.Sprintf(":%d", *port), cert,
@@ -96,11 +248,32 @@ type coordClient struct {
 	BaseURL string
 }
 
-func getOutboundIP() net.IP {
-	conn, err := net.Dial("udp", "8.8.8.8:53")
+// completeCertRotation switches to the cert generated by --rotate-cert once the coordinator trusts it.
+// The process exits after switching so it can be restarted by its supervisor using the new cert.
+func completeCertRotation(baseURL string, coordAuth rpc.Authorizer) error {
+	if !rpc.HasNextCertificate(".") {
+		return nil
+	}
+
+	next, fingerprint, err := rpc.GenNextCertificate(".")
 	if err != nil {
-		log.Fatalf("unable to determine outbound IP address: %s", err)
+		return fmt.Errorf("loading next certificate: %w", err)
+	}
+
+	resp, err := rpc.NewClient(next, time.Second*15, coordAuth).GET(context.Background(), baseURL+"/nodeinventory")
+	if ec := (&rpc.ErrUntrustedClient{}); errors.As(err, &ec) {
+		log.Printf("waiting for the coordinator to trust the next certificate: %s", fingerprint)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if err := rpc.PromoteNextCertificate("."); err != nil {
+		return fmt.Errorf("promoting next certificate: %w", err)
 	}
-	conn.Close()
-	return conn.LocalAddr().(*net.UDPAddr).IP
+	log.Printf("switched to the next certificate - exiting to restart using it")
+	os.Exit(0)
+	return nil
 }
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +15,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/inventory"
 )
 
 var runtimeCmd string
@@ -36,15 +36,28 @@ func init() {
 	runtimeCmd = "docker"
 }
 
-func syncPodman(client *coordClient, state inventoryContainer) error {
+// syncPodman converges the containers on this node with the inventory, taking one step per call.
+// Containers that have drifted from their spec are reported, or recreated when enforce is set.
+// Images are loaded from archives downloaded using the fetcher when it's set, rather than pulled from their registry.
+func syncPodman(decrypter secretDecrypter, fetcher imageFetcher, node map[string]string, state inventoryContainer, enforce bool) error {
 	current := state.Get()
 	if current == nil {
 		return nil // nothing to do yet
 	}
 
 	goalIndex := map[string]*api.ContainerSpec{}
+	previousIndex := map[string]*api.ContainerSpec{} // containers created by agents using a previous hash version
+	startFirst := map[string]bool{}                  // names of containers replaced by starting the new one first
+	goalNames := map[string]bool{}
 	for _, container := range current.Containers {
 		goalIndex[container.Hash] = container
+		goalNames[container.Name] = true
+		for _, hash := range container.PreviousHashes {
+			previousIndex[hash] = container
+		}
+		if container.UpdateStrategy == "start-first" {
+			startFirst[container.Name] = true
+		}
 	}
 
 	existing, err := podmanPs()
@@ -53,10 +66,14 @@ func syncPodman(client *coordClient, state inventoryContainer) error {
 	}
 
 	existingIndex := map[string]*psOutput{}
+	existingNames := map[string]bool{}
 	inUseFiles := map[string]struct{}{}
 	for _, c := range existing {
 		hash := c.Labels["recomposeHash"]
-		existingIndex[hash] = c
+		if prev, ok := existingIndex[hash]; !ok || !strings.HasSuffix(prev.Names[0], nextContainerSuffix) {
+			existingIndex[hash] = c // replacements of drifted containers share their hash, and are finished first
+		}
+		existingNames[c.Names[0]] = true
 		for _, mount := range strings.Split(c.Labels["recomposeMounts"], ",") {
 			inUseFiles[mount] = struct{}{}
 		}
@@ -73,6 +90,9 @@ func syncPodman(client *coordClient, state inventoryContainer) error {
 		if _, ok := goalIndex[hash]; ok {
 			continue // container should still exist
 		}
+		if _, ok := previousIndex[hash]; ok {
+			continue // container should still exist
+		}
 		if _, ok := existingIndex[hash]; ok {
 			continue // container still exists
 		}
@@ -81,6 +101,10 @@ func syncPodman(client *coordClient, state inventoryContainer) error {
 		if err != nil {
 			return fmt.Errorf("cleaning up container state file: %w", err)
 		}
+		err = os.Remove(filepath.Join("baseline", hash+".json"))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cleaning up container baseline file: %w", err)
+		}
 
 		state.ReEnter()
 		return nil
@@ -92,9 +116,12 @@ func syncPodman(client *coordClient, state inventoryContainer) error {
 			name = c.Names[0]
 			hash = c.Labels["recomposeHash"]
 		)
-		if hash != "" && goalIndex[hash] != nil {
+		if hash != "" && (goalIndex[hash] != nil || previousIndex[hash] != nil) {
 			continue // still exists in inventory
 		}
+		if goalNames[name] {
+			continue // replaced once the new image has been pulled (or once the replacement is ready when starting first)
+		}
 
 		writeState(name, hash, "Deleting", "")
 		log.Printf("removing container %q...", name)
@@ -125,11 +152,76 @@ func syncPodman(client *coordClient, state inventoryContainer) error {
 		log.Printf("cleaned up mount file %q", file.Name())
 	}
 
-	// Start missing containers
+	// Compare existing containers to the config they were created with
+	names := []string{}
+	for hash, c := range existingIndex {
+		if goalIndex[hash] != nil || previousIndex[hash] != nil {
+			names = append(names, c.Names[0])
+		}
+	}
+	live, err := podmanInspect(names...)
+	if err != nil {
+		return fmt.Errorf("inspecting containers: %s", err)
+	}
+
+	// Start missing (or drifted) containers
+	replacing := false
 	for _, c := range goalIndex {
-		if _, ok := existingIndex[c.Hash]; ok {
-			writeState(c.Name, c.Hash, "Created", "")
-			continue // already created
+		if hash, ok := findExisting(existingIndex, c); ok {
+			if existingIndex[hash].Names[0] == nextContainerName(c.Name) {
+				// Finish the replacement once the new container is ready, syncing the other containers in the meantime
+				promoted, err := promoteContainer(c, time.Unix(existingIndex[hash].Created, 0))
+				if err != nil {
+					return err
+				}
+				if promoted {
+					state.ReEnter()
+					return nil
+				}
+				replacing = true
+				continue
+			}
+
+			drift, err := checkDrift(hash, live[c.Name])
+			if err != nil {
+				return fmt.Errorf("checking container %q for drift: %w", c.Name, err)
+			}
+			if drift == "" {
+				writeState(c.Name, hash, "Created", "")
+				continue // already created
+			}
+			if !enforce {
+				writeState(c.Name, hash, "Drifted", drift)
+				continue
+			}
+			log.Printf("container %q has drifted from its spec: %s", c.Name, drift)
+		}
+
+		// Pull the image before removing the previous container to minimize downtime
+		if fetcher != nil {
+			local, err := loadImage(fetcher, c)
+			if err != nil {
+				writeState(c.Name, c.Hash, "StuckPulling", err.Error())
+				return fmt.Errorf("error while loading image for container %q: %s", c.Name, err)
+			}
+			c = local
+		} else if image := inventory.ResolvedImage(c); !podmanImageExists(image) {
+			log.Printf("pulling image %q for container %q...", image, c.Name)
+			writeState(c.Name, c.Hash, "Pulling", "")
+			if err := podmanPull(decrypter, current.Registries, image); err != nil {
+				writeState(c.Name, c.Hash, "StuckPulling", err.Error())
+				return fmt.Errorf("error while pulling image for container %q: %s", c.Name, err)
+			}
+			log.Printf("pulled image %q", image)
+		}
+
+		tc := &templateContext{Node: node, Vars: current.Vars}
+		if startFirst[c.Name] && existingNames[c.Name] {
+			if err := replaceContainer(decrypter, tc, c); err != nil {
+				return err
+			}
+			replacing = true
+			continue
 		}
 
 		log.Printf("starting container %q...", c.Name)
@@ -137,18 +229,38 @@ func syncPodman(client *coordClient, state inventoryContainer) error {
 		if err := podmanRm(c.Name); err != nil {
 			return fmt.Errorf("error while cleaning up previous container %q: %s", c.Name, err)
 		}
-		if err := podmanStart(client, c); err != nil {
+		if err := podmanStart(decrypter, tc, c); err != nil {
 			return fmt.Errorf("error while starting container %q: %s", c.Name, err)
 		}
 
 		log.Printf("started container %q", c.Name)
+		if err := recordBaseline(c); err != nil {
+			log.Printf("error while recording baseline of container %q: %s", c.Name, err)
+		}
 		state.ReEnter()
 		return nil
 	}
 
+	if replacing {
+		time.AfterFunc(replacementPollInterval, state.ReEnter) // check whether the replacements are ready
+	}
 	return nil
 }
 
+// findExisting returns the hash label of the existing container matching the spec.
+// Containers labeled with one of the spec's previous hashes are adopted so changing the hash algorithm doesn't recreate them.
+func findExisting(existingIndex map[string]*psOutput, spec *api.ContainerSpec) (string, bool) {
+	if _, ok := existingIndex[spec.Hash]; ok {
+		return spec.Hash, true
+	}
+	for _, hash := range spec.PreviousHashes {
+		if _, ok := existingIndex[hash]; ok && hash != "" {
+			return hash, true
+		}
+	}
+	return "", false
+}
+
 // TODO: {"Command":"\"/docker-entrypoint.…\"","CreatedAt":"2023-09-13 16:41:15 -0500 CDT","ID":"657a78485e76","Image":"nginx","Labels":"maintainer=NGINX Docker Maintainers \u003cdocker-maint@nginx.com\u003e","LocalVolumes":"0","Mounts":"","Names":"friendly_swirles","Networks":"bridge","Ports":"","RunningFor":"26 seconds ago","Size":"1.09kB (virtual 192MB)","State":"exited","Status":"Exited (0) 23 seconds ago"}
 
 func podmanPs() ([]*psOutput, error) {
@@ -180,7 +292,7 @@ func podmanPs() ([]*psOutput, error) {
 		dec := json.NewDecoder(reader)
 		for {
 			item := &struct {
-				Names, Labels, CreatedAt string
+				Names, Labels, CreatedAt, Image string
 				// TODO: Get StartedAt
 			}{}
 			err := dec.Decode(item)
@@ -209,6 +321,7 @@ func podmanPs() ([]*psOutput, error) {
 				Names:   []string{item.Names},
 				Labels:  labels,
 				Created: created.Unix(),
+				Image:   item.Image,
 			})
 		}
 	}
@@ -224,6 +337,7 @@ type psOutput struct {
 	Names              []string
 	Labels             map[string]string
 	Created, StartedAt int64
+	Image              string
 }
 
 func podmanRm(name string) error {
@@ -234,7 +348,39 @@ func podmanRm(name string) error {
 	return nil
 }
 
-func podmanStart(client *coordClient, spec *api.ContainerSpec) error {
+func podmanImageExists(image string) bool {
+	return exec.Command(runtimeCmd, "image", "inspect", image).Run() == nil
+}
+
+// podmanPull pulls the image using the credentials of its registry (if any).
+// Credentials are written to a temporary auth file that only exists for the duration of the pull.
+func podmanPull(decrypter secretDecrypter, registries []*api.Registry, image string) error {
+	authDir, err := writeAuthDir(decrypter, registries, image)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"pull"}
+	var env []string
+	if authDir != "" {
+		defer os.RemoveAll(authDir)
+		if runtimeCmd == "docker" {
+			env = append(os.Environ(), "DOCKER_CONFIG="+authDir)
+		} else {
+			args = append(args, "--authfile="+filepath.Join(authDir, "config.json"))
+		}
+	}
+
+	cmd := exec.Command(runtimeCmd, append(args, image)...)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s", out)
+	}
+	return nil
+}
+
+func podmanStart(decrypter secretDecrypter, tc *templateContext, spec *api.ContainerSpec) error {
 	expanded := &expandedContainerSpec{
 		Spec:             spec,
 		DecryptedSecrets: make([]string, len(spec.Secrets)),
@@ -243,18 +389,30 @@ func podmanStart(client *coordClient, spec *api.ContainerSpec) error {
 	}
 
 	// Decrypt secrets
+	tc.Secrets = map[string]string{}
 	for i, secret := range spec.Secrets {
-		val, err := decryptSecret(client, secret)
+		val, err := decrypter.Decrypt(secret)
 		if err != nil {
 			writeState(spec.Name, spec.Hash, "StuckDecryptingSecret", err.Error())
 			return fmt.Errorf("decrypting secret for env var %q: %s", secret.EnvVar, err)
 		}
 		expanded.DecryptedSecrets[i] = string(val)
+		tc.Secrets[secret.EnvVar] = string(val)
 	}
 
 	// Write files to disk
 	for i, file := range spec.Files {
-		id, abspath, err := writeFile(file)
+		content := file.Content
+		if file.Template {
+			var err error
+			content, err = renderTemplate(content, tc)
+			if err != nil {
+				writeState(spec.Name, spec.Hash, "StuckRenderingTemplate", err.Error())
+				return fmt.Errorf("rendering template for mount %q: %s", file.Path, err)
+			}
+		}
+
+		id, abspath, err := writeFile(content)
 		if err != nil {
 			writeState(spec.Name, spec.Hash, "StuckWritingFile", err.Error())
 			return fmt.Errorf("writing file for mount %q: %s", file.Path, err)
@@ -273,20 +431,10 @@ func podmanStart(client *coordClient, spec *api.ContainerSpec) error {
 	return nil
 }
 
-func decryptSecret(client *coordClient, secret *api.Secret) ([]byte, error) {
-	resp, err := client.POST(context.Background(), client.BaseURL+"/decrypt", bytes.NewBufferString(secret.Ciphertext))
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	return io.ReadAll(resp.Body)
-}
-
-func writeFile(file *api.File) (string /* id */, string /* abspath */, error) {
+func writeFile(content string) (string /* id */, string /* abspath */, error) {
 	id := uuid.Must(uuid.NewRandom()).String()
 	dest := filepath.Join("mounts", id)
-	err := os.WriteFile(dest, []byte(file.Content), 0755)
+	err := os.WriteFile(dest, []byte(content), 0755)
 	if err != nil {
 		return "", "", err
 	}
@@ -327,7 +475,7 @@ func getPodmanFlags(c *expandedContainerSpec) []string {
 		args = append(args, fmt.Sprintf("--label=recomposeMounts=%s", strings.Join(c.MountIDs, ",")))
 	}
 
-	args = append(args, c.Spec.Image)
+	args = append(args, inventory.ResolvedImage(c.Spec))
 	return append(args, c.Spec.Command...)
 }
 
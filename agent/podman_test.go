@@ -4,11 +4,13 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/concurrency"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -90,3 +92,72 @@ func TestWriteState(t *testing.T) {
 		assert.Equal(t, stat.ModTime(), prevModTime)
 	})
 }
+
+func TestFindExisting(t *testing.T) {
+	existing := map[string]*psOutput{"v2-new": {}, "legacy": {}}
+
+	hash, ok := findExisting(existing, &api.ContainerSpec{Hash: "v2-new", PreviousHashes: []string{"legacy"}})
+	assert.True(t, ok)
+	assert.Equal(t, "v2-new", hash)
+
+	hash, ok = findExisting(existing, &api.ContainerSpec{Hash: "v2-other", PreviousHashes: []string{"legacy"}})
+	assert.True(t, ok)
+	assert.Equal(t, "legacy", hash)
+
+	_, ok = findExisting(existing, &api.ContainerSpec{Hash: "v2-other"})
+	assert.False(t, ok)
+}
+
+func TestSyncPodmanPullsBeforeRemoving(t *testing.T) {
+	chdirTemp(t)
+	for _, dir := range []string{"mounts", "state", "baseline"} {
+		require.NoError(t, os.Mkdir(dir, 0755))
+	}
+
+	// The runtime has a container created from a previous version of the spec, and the new image isn't present
+	calls := filepath.Join(t.TempDir(), "calls.txt")
+	setFakeRuntime(t, `echo "$@" >> `+calls+`
+case "$1 $2" in
+	"ps "*) echo '[{"Names": ["web"], "Labels": {"createdBy": "recompose", "recomposeHash": "v2-prev"}}]' ;;
+	"image inspect") exit 1 ;;
+	"pull "*) if [ -n "$FAKE_PULL_ERROR" ]; then echo "$FAKE_PULL_ERROR" >&2; exit 1; fi ;;
+	"inspect "*) echo '[]' ;;
+esac`)
+
+	state := &concurrency.StateContainer[*api.NodeInventory]{}
+	state.Swap(&api.NodeInventory{Containers: []*api.ContainerSpec{{Name: "web", Hash: "v2-next", Image: "nginx:2"}}})
+	readCalls := func() []string {
+		buf, err := os.ReadFile(calls)
+		require.NoError(t, err)
+		return strings.Split(strings.TrimSpace(string(buf)), "\n")
+	}
+
+	// The previous container keeps running while the image can't be pulled
+	t.Setenv("FAKE_PULL_ERROR", "registry unreachable")
+	err := syncPodman(nil, nil, map[string]string{}, state, false)
+	assert.EqualError(t, err, `error while pulling image for container "web": registry unreachable`+"\n")
+	for _, call := range readCalls() {
+		assert.False(t, strings.HasPrefix(call, "rm "), "unexpected call: %s", call)
+	}
+
+	// It's replaced once the image has been pulled
+	require.NoError(t, os.Remove(calls))
+	t.Setenv("FAKE_PULL_ERROR", "")
+	require.NoError(t, syncPodman(nil, nil, map[string]string{}, state, false))
+
+	actual := []string{}
+	for _, call := range readCalls() {
+		if cmd, _, _ := strings.Cut(call, " "); cmd == "pull" || cmd == "rm" || cmd == "run" {
+			actual = append(actual, cmd)
+		}
+	}
+	assert.Equal(t, []string{"pull", "rm", "run"}, actual)
+}
+
+// chdirTemp runs the test in a temporary working directory, since the agent keeps its state relative to it.
+func chdirTemp(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() { os.Chdir(wd) })
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/inventory"
+)
+
+// writeAuthDir writes the decrypted credentials of the image's registry into a temporary directory
+// as config.json, which is read by `podman pull --authfile` and docker (using DOCKER_CONFIG).
+// Returns an empty string when the registry doesn't have credentials. Callers must remove the directory once the pull is done.
+func writeAuthDir(decrypter secretDecrypter, registries []*api.Registry, image string) (string, error) {
+	hostname := inventory.ParseImage(image).Registry
+	var registry *api.Registry
+	for _, r := range registries {
+		if r.Hostname == hostname {
+			registry = r
+		}
+	}
+	if registry == nil {
+		return "", nil
+	}
+
+	username, err := decrypter.Decrypt(&api.Secret{Ciphertext: registry.Username, Provider: registry.Provider})
+	if err != nil {
+		return "", fmt.Errorf("decrypting username of registry %q: %s", hostname, err)
+	}
+	password, err := decrypter.Decrypt(&api.Secret{Ciphertext: registry.Password, Provider: registry.Provider})
+	if err != nil {
+		return "", fmt.Errorf("decrypting password of registry %q: %s", hostname, err)
+	}
+
+	if hostname == "docker.io" {
+		hostname = "https://index.docker.io/v1/" // docker doesn't recognize docker.io
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(string(username) + ":" + string(password)))
+	buf, err := json.Marshal(map[string]any{"auths": map[string]any{hostname: map[string]string{"auth": auth}}})
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := os.MkdirTemp("", "recompose-auth-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), buf, 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
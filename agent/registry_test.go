@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jveski/recompose/internal/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testDecrypter struct{}
+
+func (testDecrypter) Decrypt(secret *api.Secret) ([]byte, error) {
+	if secret.Ciphertext == "bad" {
+		return nil, errors.New("test error")
+	}
+	return []byte("decrypted-" + secret.Ciphertext), nil
+}
+
+func TestWriteAuthDir(t *testing.T) {
+	registries := []*api.Registry{{Hostname: "ghcr.io", Username: "user", Password: "pass"}, {Hostname: "bad.example.com", Password: "bad"}}
+
+	t.Run("happy path", func(t *testing.T) {
+		dir, err := writeAuthDir(testDecrypter{}, registries, "ghcr.io/org/app:v1")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		auth := base64.StdEncoding.EncodeToString([]byte("decrypted-user:decrypted-pass"))
+		buf, err := os.ReadFile(filepath.Join(dir, "config.json"))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"auths": {"ghcr.io": {"auth": "`+auth+`"}}}`, string(buf))
+
+		info, err := os.Stat(filepath.Join(dir, "config.json"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	})
+
+	t.Run("no credentials", func(t *testing.T) {
+		dir, err := writeAuthDir(testDecrypter{}, registries, "nginx")
+		require.NoError(t, err)
+		assert.Empty(t, dir)
+	})
+
+	t.Run("decryption error", func(t *testing.T) {
+		_, err := writeAuthDir(testDecrypter{}, registries, "bad.example.com/app")
+		assert.EqualError(t, err, `decrypting password of registry "bad.example.com": test error`)
+	})
+}
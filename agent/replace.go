@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+
+	"github.com/jveski/recompose/internal/api"
+)
+
+// startFirstTimeout is how long a replacement container has to start running before it's given up on.
+// Once it's running, its healthcheck (if any) decides since the start period may be longer than this.
+const startFirstTimeout = time.Minute * 5
+
+// replacementPollInterval is how often replacement containers are checked while waiting for them to be ready.
+const replacementPollInterval = time.Second * 5
+
+const nextContainerSuffix = "-recompose-next"
+
+// nextContainerName returns the temporary name used for a container while it replaces the previous one.
+func nextContainerName(name string) string { return name + nextContainerSuffix }
+
+// replaceContainer starts the container under a temporary name alongside the previous one.
+// It's swapped in by promoteContainer on a later sync once it's ready, so other containers aren't held up in the meantime.
+// Progress is written to the container's state file: StartingNext -> WaitingForNext -> Replacing -> Created.
+func replaceContainer(decrypter secretDecrypter, tc *templateContext, spec *api.ContainerSpec) error {
+	next := *spec
+	next.Name = nextContainerName(spec.Name)
+
+	log.Printf("starting replacement container %q...", next.Name)
+	writeState(spec.Name, spec.Hash, "StartingNext", "")
+	if err := podmanRm(next.Name); err != nil {
+		return fmt.Errorf("error while cleaning up previous replacement container %q: %s", next.Name, err)
+	}
+	if err := podmanStart(decrypter, tc, &next); err != nil {
+		return fmt.Errorf("error while starting replacement container %q: %s", next.Name, err)
+	}
+
+	writeState(spec.Name, spec.Hash, "WaitingForNext", "")
+	return nil
+}
+
+// promoteContainer removes the previous container and renames the replacement once it's ready, returning true when it was promoted.
+// Replacements that fail to become ready are removed, leaving the previous container in place.
+func promoteContainer(spec *api.ContainerSpec, created time.Time) (bool, error) {
+	next := nextContainerName(spec.Name)
+
+	live, err := podmanInspect(next)
+	if err != nil {
+		return false, fmt.Errorf("error while inspecting replacement container %q: %s", next, err)
+	}
+	ready, err := containerReady(live[next])
+	if err == nil && !ready && !live[next].State.Running && time.Since(created) > startFirstTimeout {
+		err = fmt.Errorf("container wasn't running after %s", startFirstTimeout)
+	}
+	if err != nil {
+		writeState(spec.Name, spec.Hash, "StuckStartingNext", err.Error())
+		if err := podmanRm(next); err != nil {
+			log.Printf("error while removing replacement container %q: %s", next, err)
+		}
+		return false, fmt.Errorf("error while waiting for replacement container %q: %s", next, err)
+	}
+	if !ready {
+		writeState(spec.Name, spec.Hash, "WaitingForNext", "")
+		return false, nil
+	}
+
+	writeState(spec.Name, spec.Hash, "Replacing", "")
+	if err := podmanRm(spec.Name); err != nil {
+		return false, fmt.Errorf("error while removing previous container %q: %s", spec.Name, err)
+	}
+	if err := podmanRename(next, spec.Name); err != nil {
+		return false, fmt.Errorf("error while renaming replacement container %q: %s", next, err)
+	}
+
+	log.Printf("replaced container %q", spec.Name)
+	if err := recordBaseline(spec); err != nil {
+		log.Printf("error while recording baseline of container %q: %s", spec.Name, err)
+	}
+	return true, nil
+}
+
+// containerReady returns true when the container is running and its healthcheck (if any) has passed.
+// Errors are returned for containers that won't become ready on their own.
+func containerReady(live *inspectOutput) (bool, error) {
+	switch {
+	case live == nil:
+		return false, fmt.Errorf("container not found")
+	case live.State.Health.Status == "unhealthy":
+		return false, fmt.Errorf("container is unhealthy")
+	case live.State.Running:
+		return live.State.Health.Status == "" || live.State.Health.Status == "healthy", nil
+	case live.State.Status == "exited" || live.State.Status == "stopped" || live.State.Status == "dead":
+		return false, fmt.Errorf("container is %s", live.State.Status)
+	default:
+		return false, nil // still starting
+	}
+}
+
+func podmanRename(name, newName string) error {
+	out, err := exec.Command(runtimeCmd, "rename", name, newName).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s", out)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/concurrency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerReady(t *testing.T) {
+	live := func(status string, running bool, health string) *inspectOutput {
+		out := &inspectOutput{}
+		out.State.Status = status
+		out.State.Running = running
+		out.State.Health.Status = health
+		return out
+	}
+
+	tests := []struct {
+		Name  string
+		Live  *inspectOutput
+		Ready bool
+		Err   string
+	}{
+		{Name: "missing", Err: "container not found"},
+		{Name: "created", Live: live("created", false, "")},
+		{Name: "running", Live: live("running", true, ""), Ready: true},
+		{Name: "health starting", Live: live("running", true, "starting")},
+		{Name: "healthy", Live: live("running", true, "healthy"), Ready: true},
+		{Name: "unhealthy", Live: live("running", true, "unhealthy"), Err: "container is unhealthy"},
+		{Name: "exited", Live: live("exited", false, ""), Err: "container is exited"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			ready, err := containerReady(tc.Live)
+			assert.Equal(t, tc.Ready, ready)
+			if tc.Err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.Err)
+			}
+		})
+	}
+}
+
+func TestSyncPodmanStartFirst(t *testing.T) {
+	chdirTemp(t)
+	for _, dir := range []string{"mounts", "state", "baseline"} {
+		require.NoError(t, os.Mkdir(dir, 0755))
+	}
+
+	calls := filepath.Join(t.TempDir(), "calls.txt")
+	setFakeRuntime(t, `echo "$@" >> `+calls+`
+case "$1" in
+	ps) echo "$FAKE_PS" ;;
+	inspect) echo "$FAKE_INSPECT" ;;
+esac`)
+	readCalls := func() []string {
+		t.Helper()
+		buf, err := os.ReadFile(calls)
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(calls))
+
+		actual := []string{}
+		for _, call := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+			if cmd, _, _ := strings.Cut(call, " "); cmd == "rm" || cmd == "run" || cmd == "rename" {
+				actual = append(actual, call)
+			}
+		}
+		return actual
+	}
+	prev := `{"Names": ["web"], "Labels": {"createdBy": "recompose", "recomposeHash": "v2-prev"}}`
+	next := func(created time.Time) string {
+		return `{"Names": ["web-recompose-next"], "Created": ` + strconv.FormatInt(created.Unix(), 10) + `, "Labels": {"createdBy": "recompose", "recomposeHash": "v2-next"}}`
+	}
+	inspect := func(running bool, health string) string {
+		return `[{"Name": "web-recompose-next", "State": {"Running": ` + strconv.FormatBool(running) + `, "Health": {"Status": "` + health + `"}}}]`
+	}
+
+	state := &concurrency.StateContainer[*api.NodeInventory]{}
+	state.Swap(&api.NodeInventory{Containers: []*api.ContainerSpec{{Name: "web", Hash: "v2-next", Image: "nginx:2", UpdateStrategy: "start-first"}}})
+
+	// The replacement is started alongside the previous container
+	t.Setenv("FAKE_PS", "["+prev+"]")
+	require.NoError(t, syncPodman(nil, nil, map[string]string{}, state, false))
+	actual := readCalls()
+	require.Len(t, actual, 2)
+	assert.Equal(t, "rm --force web-recompose-next", actual[0])
+	assert.True(t, strings.HasPrefix(actual[1], "run "))
+
+	// Syncs don't wait for the replacement to become healthy, even past the start timeout
+	t.Setenv("FAKE_PS", "["+prev+","+next(time.Now().Add(-startFirstTimeout*2))+"]")
+	t.Setenv("FAKE_INSPECT", inspect(true, "starting"))
+	require.NoError(t, syncPodman(nil, nil, map[string]string{}, state, false))
+	assert.Empty(t, readCalls())
+	assert.Contains(t, readState(t, "v2-next"), "WaitingForNext")
+
+	// Replacements that don't start running in time are given up on
+	t.Setenv("FAKE_INSPECT", inspect(false, ""))
+	assert.Error(t, syncPodman(nil, nil, map[string]string{}, state, false))
+	assert.Equal(t, []string{"rm --force web-recompose-next"}, readCalls())
+	assert.Contains(t, readState(t, "v2-next"), "StuckStartingNext")
+
+	// The previous container is replaced once the new one is ready
+	t.Setenv("FAKE_PS", "["+prev+","+next(time.Now())+"]")
+	t.Setenv("FAKE_INSPECT", inspect(true, "healthy"))
+	require.NoError(t, syncPodman(nil, nil, map[string]string{}, state, false))
+	assert.Equal(t, []string{"rm --force web", "rename web-recompose-next web"}, readCalls())
+}
+
+func readState(t *testing.T, hash string) string {
+	t.Helper()
+	buf, err := os.ReadFile(filepath.Join("state", hash+".txt"))
+	require.NoError(t, err)
+	return string(buf)
+}
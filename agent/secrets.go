@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+
+	"github.com/jveski/recompose/internal/api"
+)
+
+// secretDecrypter decrypts the ciphertext of container secrets.
+type secretDecrypter interface {
+	Decrypt(secret *api.Secret) ([]byte, error)
+}
+
+// Decrypt sends the secret to the coordinator, which decrypts it using the secret's provider.
+func (c *coordClient) Decrypt(secret *api.Secret) ([]byte, error) {
+	u := c.BaseURL + "/decrypt"
+	if secret.Provider != "" {
+		u += "?provider=" + url.QueryEscape(secret.Provider)
+	}
+
+	resp, err := c.POST(context.Background(), u, bytes.NewBufferString(secret.Ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// localDecrypter decrypts age-encrypted secrets using a local identity file.
+// Used by agents that run without a coordinator.
+type localDecrypter struct {
+	IdentityFile string
+}
+
+func (l *localDecrypter) Decrypt(secret *api.Secret) ([]byte, error) {
+	if secret.Provider != "" && secret.Provider != "age" {
+		return nil, fmt.Errorf("secret provider %q is only supported by the coordinator", secret.Provider)
+	}
+	if l.IdentityFile == "" {
+		return nil, fmt.Errorf("an identity file (--identity) is required to decrypt secrets")
+	}
+
+	cmd := exec.Command("age", "--decrypt", "--identity="+l.IdentityFile)
+	cmd.Stdin = bytes.NewBufferString(secret.Ciphertext)
+	out, err := cmd.Output()
+	if ee, ok := err.(*exec.ExitError); ok {
+		return nil, fmt.Errorf("age error: %s", bytes.TrimSpace(ee.Stderr))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(out, []byte("\n")), nil // trim off trailing newline, like the coordinator
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/inventory"
+)
+
+// syncLocalInventory reads the inventory from a local directory rather than the coordinator.
+func syncLocalInventory(dir string, nodeIDs []string, state inventoryContainer) error {
+	inv, err := readLocalInventory(dir, nodeIDs)
+	if err != nil {
+		return err
+	}
+	if current := state.Get(); current != nil && current.GitSHA == inv.GitSHA {
+		return nil // already in sync
+	}
+
+	log.Printf("read inventory from %q at version: %s", dir, inv.GitSHA)
+	state.Swap(inv)
+	return nil
+}
+
+// readLocalInventory reads a cluster.toml layout, or the container files of a single node when there is no cluster.toml.
+// Nodes in cluster.toml are matched by any of the given IDs (names or fingerprints), or the only node if there is just one.
+// Since there's no git SHA, the version is a hash of the inventory's content.
+func readLocalInventory(dir string, nodeIDs []string) (*api.NodeInventory, error) {
+	cluster, err := inventory.ReadCluster(dir)
+	if os.IsNotExist(err) {
+		inv, err := inventory.ReadDir(dir, "")
+		if err != nil {
+			return nil, err
+		}
+		inv.GitSHA = inventory.ContentHash(inv)
+		return inv, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading cluster.toml: %w", err)
+	}
+
+	node := findLocalNode(cluster, nodeIDs)
+	if node == nil {
+		return nil, errors.New("this node is not declared in cluster.toml - set --node to its name or fingerprint")
+	}
+
+	inv := inventory.BuildNode(dir, cluster, node, "", map[string]*api.ContainerSpec{})
+	inv.GitSHA = inventory.ContentHash(inv)
+	return inv, nil
+}
+
+func findLocalNode(cluster *inventory.ClusterSpec, ids []string) *inventory.NodeSpec {
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		if node := cluster.FindNode(id); node != nil {
+			return node
+		}
+	}
+	if len(cluster.Nodes) == 1 {
+		return cluster.Nodes[0]
+	}
+	return nil
+}
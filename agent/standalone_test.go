@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadLocalInventory(t *testing.T) {
+	t.Run("cluster", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "cluster.toml"), []byte(`
+[[ node ]]
+name = "node-1"
+containers = ["nginx.toml"]
+
+[[ node ]]
+fingerprint = "test-fingerprint"
+containers = []
+`), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "nginx.toml"), []byte(`image = "nginx"`), 0644))
+
+		inv, err := readLocalInventory(dir, []string{"", "node-1"})
+		require.NoError(t, err)
+		require.Len(t, inv.Containers, 1)
+		assert.NotEmpty(t, inv.GitSHA)
+
+		inv, err = readLocalInventory(dir, []string{"test-fingerprint"})
+		require.NoError(t, err)
+		assert.Len(t, inv.Containers, 0)
+
+		_, err = readLocalInventory(dir, []string{"unknown"})
+		assert.Error(t, err)
+	})
+
+	t.Run("single node", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "nginx.toml"), []byte(`image = "nginx"`), 0644))
+
+		inv, err := readLocalInventory(dir, nil)
+		require.NoError(t, err)
+		require.Len(t, inv.Containers, 1)
+		assert.Equal(t, "nginx", inv.Containers[0].Name)
+
+		// The version only changes with the content
+		again, err := readLocalInventory(dir, nil)
+		require.NoError(t, err)
+		assert.Equal(t, inv.GitSHA, again.GitSHA)
+	})
+}
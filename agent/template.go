@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// templateContext holds the values available to templated files.
+//
+// Files can reference them like this:
+//
+//	{{ secret "DB_PASSWORD" }} - the decrypted value of the container's secret with the given env var
+//	{{ node.ip }}              - properties of the node running the container
+//	{{ vars.db_host }}         - cluster-level variables declared in cluster.toml
+type templateContext struct {
+	Node    map[string]string
+	Vars    map[string]string
+	Secrets map[string]string // keyed by env var
+}
+
+func renderTemplate(content string, tc *templateContext) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Funcs(template.FuncMap{
+		"node": func() map[string]string { return tc.Node },
+		"vars": func() map[string]string { return tc.Vars },
+		"secret": func(name string) (string, error) {
+			val, ok := tc.Secrets[name]
+			if !ok {
+				return "", fmt.Errorf("secret %q is not defined by the container", name)
+			}
+			return val, nil
+		},
+	}).Parse(content)
+	if err != nil {
+		return "", fmt.Errorf("parsing template: %w", err)
+	}
+
+	buf := &strings.Builder{}
+	if err := tmpl.Execute(buf, nil); err != nil {
+		return "", fmt.Errorf("executing template: %w", err)
+	}
+	return buf.String(), nil
+}
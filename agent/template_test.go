@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	tc := &templateContext{
+		Node:    map[string]string{"ip": "10.0.0.1"},
+		Vars:    map[string]string{"db_host": "db.internal"},
+		Secrets: map[string]string{"DB_PASSWORD": "hunter2"},
+	}
+
+	t.Run("happy path", func(t *testing.T) {
+		actual, err := renderTemplate(`host={{ vars.db_host }} ip={{ node.ip }} password={{ secret "DB_PASSWORD" }}`, tc)
+		require.NoError(t, err)
+		assert.Equal(t, "host=db.internal ip=10.0.0.1 password=hunter2", actual)
+	})
+
+	t.Run("missing secret", func(t *testing.T) {
+		_, err := renderTemplate(`{{ secret "NOPE" }}`, tc)
+		assert.ErrorContains(t, err, `secret "NOPE" is not defined by the container`)
+	})
+
+	t.Run("missing variable", func(t *testing.T) {
+		_, err := renderTemplate(`{{ vars.nope }}`, tc)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jveski/recompose/internal/concurrency"
+	"github.com/jveski/recompose/internal/rpc"
+)
+
+// tunnelListener accepts the connections this agent opens to the coordinator, which allows the coordinator
+// to reach the agent's API without inbound connectivity. A few idle tunnels are kept open at all times.
+type tunnelListener struct {
+	Endpoint string
+	TLS      *tls.Config
+	Idle     int
+
+	conns chan net.Conn
+	lock  sync.Mutex
+	idle  map[net.Conn]chan struct{} // closed once the tunnel is used or closed
+}
+
+func newTunnelListener(endpoint string, config *tls.Config, idle int) *tunnelListener {
+	return &tunnelListener{
+		Endpoint: endpoint,
+		TLS:      config,
+		Idle:     idle,
+		conns:    make(chan net.Conn),
+		idle:     make(map[net.Conn]chan struct{}),
+	}
+}
+
+// Serve serves the given handler over tunnels until the process exits.
+func (t *tunnelListener) Serve(handler http.Handler) error {
+	for i := 0; i < t.Idle; i++ {
+		go concurrency.RunLoop(nil, 0, time.Minute, func() bool {
+			err := t.open()
+			if err != nil {
+				log.Printf("error opening tunnel to coordinator: %s", err)
+			}
+			return err == nil
+		})
+	}
+
+	svr := &http.Server{Handler: handler, ConnState: t.connState, IdleTimeout: time.Minute * 15}
+	return svr.Serve(t)
+}
+
+// open dials a tunnel and blocks until it's been used, closed, or recycled.
+func (t *tunnelListener) open() error {
+	ctx, done := context.WithTimeout(context.Background(), time.Second*30)
+	defer done()
+
+	conn, err := rpc.DialTunnel(ctx, t.Endpoint, t.TLS)
+	if err != nil {
+		return err
+	}
+
+	used := make(chan struct{})
+	t.lock.Lock()
+	t.idle[conn] = used
+	t.lock.Unlock()
+	t.conns <- conn
+
+	select {
+	case <-used:
+	case <-time.After(concurrency.Jitter(time.Minute * 15)):
+		// Recycle idle tunnels so connections silently dropped by NATs and firewalls don't accumulate
+		t.lock.Lock()
+		_, idle := t.idle[conn]
+		delete(t.idle, conn)
+		t.lock.Unlock()
+		if idle {
+			conn.Close()
+		}
+	}
+	return nil
+}
+
+func (t *tunnelListener) connState(conn net.Conn, state http.ConnState) {
+	if state == http.StateNew || state == http.StateIdle {
+		return
+	}
+
+	t.lock.Lock()
+	used := t.idle[conn]
+	delete(t.idle, conn)
+	t.lock.Unlock()
+	if used != nil {
+		close(used)
+	}
+}
+
+func (t *tunnelListener) Accept() (net.Conn, error) { return <-t.conns, nil }
+func (t *tunnelListener) Close() error              { return nil }
+func (t *tunnelListener) Addr() net.Addr            { return &net.TCPAddr{} }
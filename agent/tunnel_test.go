@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jveski/recompose/internal/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelListener(t *testing.T) {
+	pool := rpc.NewTunnelPool()
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pool.Accept("test-node", w, r)
+	}))
+	defer svr.Close()
+
+	cert, _, err := rpc.GenCertificate(t.TempDir())
+	require.NoError(t, err)
+	tunnels := newTunnelListener(svr.URL+"/tunnel", &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}}, 1)
+	go tunnels.Serve(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("test-response"))
+	}))
+
+	get := func() string {
+		var conn net.Conn
+		require.Eventually(t, func() bool {
+			conn = pool.Take("test-node")
+			return conn != nil
+		}, time.Second*5, time.Millisecond*10)
+
+		client := &http.Client{Transport: &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) { return conn, nil },
+		}}
+		resp, err := client.Get("https://test-node/")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// Used tunnels are replaced with new ones
+	assert.Equal(t, "test-response", get())
+	assert.Equal(t, "test-response", get())
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"path/filepath"
+	"syscall"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_ATTRIB
+
+// watchDir returns a channel that receives when anything in the directory tree changes, using inotify.
+func watchDir(dir string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	if err := addWatches(fd, dir); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 1<<16)
+		for {
+			if _, err := syscall.Read(fd, buf); err != nil {
+				if err == syscall.EINTR {
+					continue
+				}
+				log.Printf("error while watching inventory directory - falling back to polling: %s", err)
+				return
+			}
+
+			// Newly created directories need their own watches
+			if err := addWatches(fd, dir); err != nil {
+				log.Printf("error while watching inventory directory: %s", err)
+			}
+
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func addWatches(fd int, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		_, err = syscall.InotifyAddWatch(fd, path, watchMask)
+		return err
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchDir(t *testing.T) {
+	dir := t.TempDir()
+	ch, err := watchDir(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "subdir"), 0755))
+	waitForChange(t, ch)
+
+	// Directories created after the watch started are also watched
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "subdir", "test.toml"), []byte("test"), 0644))
+	waitForChange(t, ch)
+}
+
+func waitForChange(t *testing.T, ch <-chan struct{}) {
+	select {
+	case <-ch:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for change")
+	}
+	time.Sleep(time.Millisecond * 50)
+	select {
+	case <-ch: // drain coalesced events
+	default:
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+// watchDir returns a channel that receives periodically since inotify is only available on Linux.
+func watchDir(dir string) (<-chan struct{}, error) {
+	ch := make(chan struct{})
+	go func() {
+		for range time.Tick(time.Second * 5) {
+			ch <- struct{}{}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/inventory"
+)
+
+type digestResolver interface {
+	// Resolve returns the digest the image's tag points to, authenticating with the registry's credentials when given.
+	Resolve(ctx context.Context, image string, registry *api.Registry) (string, error)
+}
+
+// registryResolver resolves image tags to digests using the registry's HTTP API.
+type registryResolver struct {
+	Client    *http.Client
+	PlainHTTP bool                     // only useful for local registries
+	Secrets   map[string]secretBackend // decrypts the credentials of registries declared in cluster.toml
+}
+
+var manifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+func (r *registryResolver) Resolve(ctx context.Context, image string, registry *api.Registry) (string, error) {
+	ref := inventory.ParseImage(image)
+	if ref.Digest != "" {
+		return ref.Digest, nil
+	}
+
+	var username, password string
+	if registry != nil {
+		var err error
+		if username, password, err = decryptRegistryCredentials(ctx, r.Secrets, registry); err != nil {
+			return "", err
+		}
+	}
+
+	scheme, host := "https", ref.Registry
+	if r.PlainHTTP {
+		scheme = "http"
+	}
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	u := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, host, ref.Repository, ref.Tag)
+
+	resp, err := r.head(ctx, u, "")
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == 401 {
+		auth, err := r.authorize(ctx, resp.Header.Get("WWW-Authenticate"), username, password)
+		if err != nil {
+			return "", fmt.Errorf("getting registry token: %w", err)
+		}
+		if resp, err = r.head(ctx, u, auth); err != nil {
+			return "", err
+		}
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("registry returned status %d for %s", resp.StatusCode, image)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry didn't return a digest for %s", image)
+	}
+	return digest, nil
+}
+
+func (r *registryResolver) head(ctx context.Context, url, auth string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// authorize returns the Authorization header that answers the registry's challenge.
+// Registries using basic auth get the credentials directly, otherwise they're exchanged for a bearer token
+// i.e. `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"`.
+// The token is anonymous when the registry doesn't have credentials.
+func (r *registryResolver) authorize(ctx context.Context, challenge, username, password string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if strings.EqualFold(scheme, "basic") && username != "" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+	}
+	if !strings.EqualFold(scheme, "bearer") {
+		return "", fmt.Errorf("unsupported auth challenge %q", challenge)
+	}
+
+	q := url.Values{}
+	var realm string
+	for _, param := range strings.Split(params, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+		val = strings.Trim(val, `"`)
+		if key == "realm" {
+			realm = val
+		} else {
+			q.Set(key, val)
+		}
+	}
+	if realm == "" {
+		return "", fmt.Errorf("auth challenge %q is missing the realm", challenge)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", realm+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("auth server returned status %d", resp.StatusCode)
+	}
+
+	body := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token == "" {
+		return "Bearer " + body.AccessToken, nil
+	}
+	return "Bearer " + body.Token, nil
+}
+
+// digestTracker caches the digests of images used by containers with `image_policy = "track"`.
+// The cache is persisted to File (when set) so containers stay pinned to their last known digest
+// across restarts, even while the registry is unreachable.
+type digestTracker struct {
+	Resolver digestResolver
+	Timeout  time.Duration
+	File     string
+
+	lock       sync.Mutex
+	loaded     bool
+	digests    map[string]string        // image -> digest, empty until it's been resolved
+	registries map[string]*api.Registry // hostname -> credentials declared in cluster.toml
+}
+
+// Apply pins the tracked containers of the inventory to the cached digest of their image.
+// Images that haven't been resolved yet are resolved first, and images no longer in use are evicted from the cache.
+// Containers whose image has never been resolved use the tag until a later refresh succeeds.
+func (d *digestTracker) Apply(inv *indexedInventory) {
+	specs := map[*api.ContainerSpec]struct{}{} // containers are shared between nodes
+	images := map[string]string{}
+	registries := map[string]*api.Registry{}
+	for _, node := range inv.NodesByID {
+		for _, container := range node.Containers {
+			if inventory.IsTracked(container) {
+				specs[container] = struct{}{}
+				images[container.Image] = ""
+			}
+		}
+		for _, registry := range node.Registries {
+			registries[registry.Hostname] = registry
+		}
+	}
+
+	d.lock.Lock()
+	d.load()
+	for image := range images {
+		images[image] = d.digests[image]
+	}
+	d.registries = registries
+	d.lock.Unlock()
+
+	for image, digest := range images {
+		if digest != "" {
+			continue
+		}
+		digest, err := d.resolve(image)
+		if err != nil {
+			log.Printf("error while resolving digest of image %q (will retry): %s", image, err)
+			continue
+		}
+		images[image] = digest
+	}
+
+	// Refresh may have resolved images again in the meantime, so only empty digests are filled in
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.digests == nil {
+		d.digests = map[string]string{}
+	}
+	for image := range d.digests {
+		if _, ok := images[image]; !ok {
+			delete(d.digests, image) // no longer in use
+		}
+	}
+	for image, digest := range images {
+		if current := d.digests[image]; current != "" {
+			images[image] = current
+		} else {
+			d.digests[image] = digest
+		}
+	}
+	d.save()
+
+	for spec := range specs {
+		if digest := images[spec.Image]; digest != "" {
+			inventory.PinDigest(spec, digest)
+		}
+	}
+	inv.Digests = inventory.FoldHash("", images)
+}
+
+// Refresh resolves every cached image again (including those that failed to resolve), returning true if any of their digests changed.
+// Images that can't be resolved keep their last known digest.
+func (d *digestTracker) Refresh() (bool, error) {
+	d.lock.Lock()
+	images := make([]string, 0, len(d.digests))
+	for image := range d.digests {
+		images = append(images, image)
+	}
+	d.lock.Unlock()
+
+	var (
+		changed bool
+		errs    []string
+	)
+	for _, image := range images {
+		digest, err := d.resolve(image)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("resolving digest of image %q: %s", image, err))
+			continue
+		}
+
+		d.lock.Lock()
+		if prev, ok := d.digests[image]; ok && prev != digest {
+			log.Printf("image %q now resolves to %s (was %q)", image, digest, prev)
+			d.digests[image] = digest
+			changed = true
+		}
+		d.lock.Unlock()
+	}
+
+	if changed {
+		d.lock.Lock()
+		d.save()
+		d.lock.Unlock()
+	}
+	if len(errs) > 0 {
+		return changed, errors.New(strings.Join(errs, "; "))
+	}
+	return changed, nil
+}
+
+// Version changes whenever the digest of any cached image changes.
+func (d *digestTracker) Version() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.load()
+	return inventory.FoldHash("", d.digests)
+}
+
+func (d *digestTracker) resolve(image string) (string, error) {
+	d.lock.Lock()
+	registry := d.registries[inventory.ParseImage(image).Registry]
+	d.lock.Unlock()
+
+	ctx, done := context.WithTimeout(context.Background(), d.Timeout)
+	defer done()
+	return d.Resolver.Resolve(ctx, image, registry)
+}
+
+// load reads the digests persisted by a previous process. Must be called while holding the lock.
+func (d *digestTracker) load() {
+	if d.loaded || d.File == "" {
+		return
+	}
+	d.loaded = true
+
+	file := struct{ Digests map[string]string }{}
+	if _, err := toml.DecodeFile(d.File, &file); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("error while reading image digests: %s", err)
+		}
+		return
+	}
+	d.digests = file.Digests
+}
+
+// save persists the digests. Must be called while holding the lock.
+func (d *digestTracker) save() {
+	if d.File == "" {
+		return
+	}
+	buf := &bytes.Buffer{}
+	if err := toml.NewEncoder(buf).Encode(struct{ Digests map[string]string }{d.digests}); err != nil {
+		log.Printf("error while encoding image digests: %s", err)
+		return
+	}
+	tmp := d.File + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		log.Printf("error while writing image digests: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, d.File); err != nil {
+		log.Printf("error while writing image digests: %s", err)
+	}
+}
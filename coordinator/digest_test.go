@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/concurrency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRegistry serves the digest of org/app:v1 to clients holding a token from its auth server.
+// Tokens for org/private:v1 are only issued to clients authenticating as test-user.
+func newTestRegistry(t *testing.T, digest *atomic.Pointer[string]) *httptest.Server {
+	var svr *httptest.Server
+	svr = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		switch {
+		case r.URL.Path == "/token" && r.URL.Query().Get("scope") == "repository:org/app:pull":
+			w.Write([]byte(`{"token": "test-token"}`))
+		case r.URL.Path == "/token" && r.URL.Query().Get("scope") == "repository:org/private:pull" && username == "test-user" && password == "test-password":
+			w.Write([]byte(`{"access_token": "private-token"}`))
+		case r.URL.Path == "/token":
+			w.WriteHeader(401)
+		case r.URL.Path == "/v2/org/private/manifests/v1" && r.Header.Get("Authorization") == "Bearer private-token":
+			w.Header().Set("Docker-Content-Digest", "sha256:private")
+		case r.URL.Path == "/v2/org/private/manifests/v1":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:org/private:pull"`, svr.URL))
+			w.WriteHeader(401)
+		case r.URL.Path != "/v2/org/app/manifests/v1":
+			w.WriteHeader(404)
+		case r.Header.Get("Authorization") != "Bearer test-token":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:org/app:pull"`, svr.URL))
+			w.WriteHeader(401)
+		case !strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json"):
+			w.WriteHeader(400)
+		default:
+			w.Header().Set("Docker-Content-Digest", *digest.Load())
+		}
+	}))
+	t.Cleanup(svr.Close)
+	return svr
+}
+
+func TestRegistryResolver(t *testing.T) {
+	digest := &atomic.Pointer[string]{}
+	digest.Store(strPtr("sha256:1"))
+	svr := newTestRegistry(t, digest)
+	host := strings.TrimPrefix(svr.URL, "http://")
+	secretsDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(secretsDir, "username"), []byte("test-user\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(secretsDir, "password"), []byte("test-password\n"), 0644))
+	resolver := &registryResolver{Client: svr.Client(), PlainHTTP: true, Secrets: map[string]secretBackend{"file": &fileBackend{Dir: secretsDir}}}
+
+	actual, err := resolver.Resolve(context.Background(), host+"/org/app:v1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:1", actual)
+
+	_, err = resolver.Resolve(context.Background(), host+"/org/app:v2", nil)
+	assert.EqualError(t, err, fmt.Sprintf("registry returned status 404 for %s/org/app:v2", host))
+
+	// Images pinned to a digest don't need to be resolved
+	actual, err = resolver.Resolve(context.Background(), "nowhere.invalid/org/app@sha256:2", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:2", actual)
+
+	// Private images are resolved using the registry's credentials
+	_, err = resolver.Resolve(context.Background(), host+"/org/private:v1", nil)
+	assert.EqualError(t, err, "getting registry token: auth server returned status 401")
+
+	registry := &api.Registry{Hostname: host, Username: "username", Password: "password", Provider: "file"}
+	actual, err = resolver.Resolve(context.Background(), host+"/org/private:v1", registry)
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:private", actual)
+}
+
+// fakeResolver resolves images using a static map, failing for images that aren't in it.
+type fakeResolver struct {
+	lock    sync.Mutex
+	digests map[string]string
+}
+
+func (f *fakeResolver) Set(image, digest string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if digest == "" {
+		delete(f.digests, image)
+	} else {
+		f.digests[image] = digest
+	}
+}
+
+func (f *fakeResolver) Resolve(ctx context.Context, image string, registry *api.Registry) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if digest, ok := f.digests[image]; ok {
+		return digest, nil
+	}
+	return "", errors.New("registry unreachable")
+}
+
+func TestDigestTrackerUnreachableRegistry(t *testing.T) {
+	newInventory := func() *indexedInventory {
+		inv := newIndexedInventory("test")
+		inv.NodesByID["node-1"] = &api.NodeInventory{Containers: []*api.ContainerSpec{{Name: "app", Hash: "v2-test", Image: "org/app:v1", ImagePolicy: "track"}}}
+		return inv
+	}
+	resolver := &fakeResolver{digests: map[string]string{}}
+	file := filepath.Join(t.TempDir(), "digests.toml")
+	tracker := &digestTracker{Resolver: resolver, Timeout: time.Second, File: file}
+
+	// Images that can't be resolved use the tag, and are retried by the next refresh
+	inv := newInventory()
+	tracker.Apply(inv)
+	assert.Empty(t, inv.NodesByID["node-1"].Containers[0].ImageDigest)
+
+	resolver.Set("org/app:v1", "sha256:1")
+	changed, err := tracker.Refresh()
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	inv = newInventory()
+	tracker.Apply(inv)
+	assert.Equal(t, "sha256:1", inv.NodesByID["node-1"].Containers[0].ImageDigest)
+
+	// The last known digest is kept while the registry is unreachable, including after restarting
+	resolver.Set("org/app:v1", "")
+	changed, err = tracker.Refresh()
+	assert.EqualError(t, err, `resolving digest of image "org/app:v1": registry unreachable`)
+	assert.False(t, changed)
+
+	restarted := &digestTracker{Resolver: resolver, Timeout: time.Second, File: file}
+	inv = newInventory()
+	restarted.Apply(inv)
+	assert.Equal(t, "sha256:1", inv.NodesByID["node-1"].Containers[0].ImageDigest)
+	assert.Equal(t, tracker.Version(), restarted.Version())
+}
+
+// hookResolver calls the hook before resolving each image.
+type hookResolver struct {
+	digestResolver
+	hook func(image string)
+}
+
+func (h *hookResolver) Resolve(ctx context.Context, image string, registry *api.Registry) (string, error) {
+	h.hook(image)
+	return h.digestResolver.Resolve(ctx, image, registry)
+}
+
+func TestDigestTrackerConcurrentRefresh(t *testing.T) {
+	newInventory := func(images ...string) *indexedInventory {
+		inv := newIndexedInventory("test")
+		node := &api.NodeInventory{}
+		for _, image := range images {
+			node.Containers = append(node.Containers, &api.ContainerSpec{Name: image, Hash: "v2-test", Image: image, ImagePolicy: "track"})
+		}
+		inv.NodesByID["node-1"] = node
+		return inv
+	}
+	resolver := &fakeResolver{digests: map[string]string{"org/a:v1": "sha256:a1", "org/b:v1": "sha256:b1"}}
+	tracker := &digestTracker{Timeout: time.Second}
+	tracker.Resolver = &hookResolver{digestResolver: resolver, hook: func(image string) {}}
+	tracker.Apply(newInventory("org/a:v1"))
+
+	// The tag of a cached image is pushed to, and refreshed while a new image is being resolved
+	tracker.Resolver.(*hookResolver).hook = func(image string) {
+		if image == "org/b:v1" {
+			resolver.Set("org/a:v1", "sha256:a2")
+			changed, err := tracker.Refresh()
+			require.NoError(t, err)
+			assert.True(t, changed)
+		}
+	}
+	inv := newInventory("org/a:v1", "org/b:v1")
+	tracker.Apply(inv)
+	assert.Equal(t, "sha256:a2", inv.NodesByID["node-1"].Containers[0].ImageDigest)
+	assert.Equal(t, "sha256:b1", inv.NodesByID["node-1"].Containers[1].ImageDigest)
+	assert.Equal(t, tracker.Version(), inv.Digests)
+
+	// Images that are no longer in use are evicted
+	inv = newInventory("org/b:v1")
+	tracker.Apply(inv)
+	assert.Equal(t, inv.Digests, tracker.Version())
+}
+
+func TestSyncInventoryTrackedImages(t *testing.T) {
+	digest := &atomic.Pointer[string]{}
+	digest.Store(strPtr("sha256:1"))
+	svr := newTestRegistry(t, digest)
+	image := strings.TrimPrefix(svr.URL, "http://") + "/org/app:v1"
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cluster.toml"), []byte("[[node]]\nname = 'node-1'\ncontainers = ['tracked.toml', 'static.toml']\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tracked.toml"), []byte(fmt.Sprintf("image = %q\nimage_policy = 'track'", image)), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "static.toml"), []byte(fmt.Sprintf("image = %q", image)), 0644))
+
+	source := &dirSource{Path: dir}
+	state := &concurrency.StateContainer[*indexedInventory]{}
+	history := &deploymentHistory{File: filepath.Join(t.TempDir(), "history.toml")}
+	tracker := &digestTracker{Resolver: &registryResolver{Client: svr.Client(), PlainHTTP: true}, Timeout: time.Second}
+
+	require.NoError(t, syncInventory(source, state, newNodeMetadataStore(), history, tracker, "startup"))
+	tracked, static := state.Get().NodesByName["node-1"].Containers[0], state.Get().NodesByName["node-1"].Containers[1]
+	assert.Equal(t, "sha256:1", tracked.ImageDigest)
+	assert.Empty(t, static.ImageDigest)
+	prevHash := tracked.Hash
+
+	// No changes
+	changed, err := tracker.Refresh()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// Pushing to the tag rolls out the new digest
+	digest.Store(strPtr("sha256:2"))
+	changed, err = tracker.Refresh()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	require.NoError(t, syncInventory(source, state, newNodeMetadataStore(), history, tracker, "digest"))
+
+	tracked = state.Get().NodesByName["node-1"].Containers[0]
+	assert.Equal(t, "sha256:2", tracked.ImageDigest)
+	assert.NotEqual(t, prevHash, tracked.Hash)
+
+	deployments, err := history.List()
+	require.NoError(t, err)
+	require.Len(t, deployments, 2)
+	assert.Equal(t, "digest", deployments[1].Trigger)
+	assert.Equal(t, []string{"tracked"}, deployments[1].Nodes[0].Changed)
+}
+
+func strPtr(s string) *string { return &s }
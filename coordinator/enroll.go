@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	maxPendingNodes          = 256
+	maxPendingNodesPerSource = 16
+	pendingNodeExpiry        = time.Hour // agents re-enroll every few minutes while waiting for approval
+)
+
+// pendingNode is an agent that isn't declared in cluster.toml but has asked to join the cluster.
+type pendingNode struct {
+	Fingerprint string
+	IP          string
+	Source      string // remote address of the enrollment request
+	Facts       map[string]string
+	Time        time.Time
+}
+
+type pendingNodeStore struct {
+	lock          sync.Mutex
+	byFingerprint map[string]*pendingNode
+}
+
+func newPendingNodeStore() *pendingNodeStore {
+	return &pendingNodeStore{byFingerprint: make(map[string]*pendingNode)}
+}
+
+// Set records the pending node, evicting the oldest node of the same source (or of any source) when full.
+// Agents re-enroll every few minutes, so a flood of enrollments can't lock them out.
+func (p *pendingNodeStore) Set(node *pendingNode) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.prune()
+	if _, ok := p.byFingerprint[node.Fingerprint]; !ok {
+		if p.count(node.Source) >= maxPendingNodesPerSource {
+			p.evictOldest(node.Source)
+		} else if len(p.byFingerprint) >= maxPendingNodes {
+			p.evictOldest("")
+		}
+	}
+	p.byFingerprint[node.Fingerprint] = node
+}
+
+func (p *pendingNodeStore) List() []*pendingNode {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.prune()
+	list := make([]*pendingNode, 0, len(p.byFingerprint))
+	for _, node := range p.byFingerprint {
+		list = append(list, node)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	return list
+}
+
+func (p *pendingNodeStore) count(source string) int {
+	n := 0
+	for _, node := range p.byFingerprint {
+		if node.Source == source {
+			n++
+		}
+	}
+	return n
+}
+
+// evictOldest removes the oldest node enrolled from the given source, or from any source if empty.
+func (p *pendingNodeStore) evictOldest(source string) {
+	var oldest *pendingNode
+	for _, node := range p.byFingerprint {
+		if source != "" && node.Source != source {
+			continue
+		}
+		if oldest == nil || node.Time.Before(oldest.Time) {
+			oldest = node
+		}
+	}
+	if oldest != nil {
+		delete(p.byFingerprint, oldest.Fingerprint)
+	}
+}
+
+func (p *pendingNodeStore) prune() {
+	for key, node := range p.byFingerprint {
+		if time.Since(node.Time) > pendingNodeExpiry {
+			delete(p.byFingerprint, key)
+		}
+	}
+}
+
+// newEnrollHandler records agents that aren't in the inventory as pending nodes.
+// Agents must present the join token when one is configured.
+// The body holds TOML-encoded facts about the node i.e. its hostname.
+// Nothing here is authenticated, so the ip and facts are validated before they're shown to operators.
+// Without a join token any client can enroll, so the number of pending nodes per source address is capped.
+func newEnrollHandler(state inventoryContainer, store *pendingNodeStore, joinToken []byte) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if len(joinToken) > 0 && !hmac.Equal([]byte(token), joinToken) {
+			w.WriteHeader(403)
+			return
+		}
+
+		q := r.URL.Query()
+		fingerprint := q.Get("fingerprint")
+		ip := q.Get("ip")
+		if ip != "" && net.ParseIP(ip) == nil { // agents only reachable over tunnels may not have one
+			http.Error(w, "invalid ip", 400)
+			return
+		}
+		if state.Get().Node(fingerprint, "") != nil {
+			return // already a member
+		}
+
+		facts := map[string]string{}
+		if _, err := toml.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&facts); err != nil {
+			http.Error(w, "invalid facts", 400)
+			return
+		}
+		for key, val := range facts {
+			if hasControlChars(key) || hasControlChars(val) || strings.ContainsAny(key, "= ") {
+				http.Error(w, "invalid facts", 400)
+				return
+			}
+		}
+
+		source, _, _ := net.SplitHostPort(r.RemoteAddr)
+		store.Set(&pendingNode{Fingerprint: fingerprint, IP: ip, Source: source, Facts: facts, Time: time.Now()})
+		log.Printf("node is pending approval: %s - ip=%s", fingerprint, ip)
+	}
+}
+
+// newGetPendingNodesHandler lists the pending nodes as CSV rows of fingerprint, ip, enrollment time, and facts.
+// Facts are formatted as space-separated key=value pairs.
+func newGetPendingNodesHandler(state inventoryContainer, store *pendingNodeStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		inv := state.Get()
+
+		cw := csv.NewWriter(w)
+		for _, node := range store.List() {
+			if inv.Node(node.Fingerprint, "") != nil {
+				continue // approved since enrolling
+			}
+			cw.Write([]string{node.Fingerprint, node.IP, strconv.FormatInt(node.Time.Unix(), 10), formatFacts(node.Facts)})
+		}
+		cw.Flush()
+	}
+}
+
+func formatFacts(facts map[string]string) string {
+	keys := make([]string, 0, len(facts))
+	for key := range facts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf("%s=%s", key, facts[key])
+	}
+	return strings.Join(pairs, " ")
+}
+
+func hasControlChars(str string) bool {
+	return strings.IndexFunc(str, unicode.IsControl) >= 0
+}
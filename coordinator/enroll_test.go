@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/concurrency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnroll(t *testing.T) {
+	state := &concurrency.StateContainer[*indexedInventory]{}
+	inv := newIndexedInventory("")
+	inv.NodesByFingerprint["known-node"] = &api.NodeInventory{}
+	state.Swap(inv)
+
+	store := newPendingNodeStore()
+	fn := newEnrollHandler(state, store, []byte("test-token"))
+
+	enrollWith := func(fingerprint, token, ip, facts string) int {
+		r := httptest.NewRequest("POST", "/?ip="+url.QueryEscape(ip)+"&fingerprint="+fingerprint, bytes.NewBufferString(facts))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		fn(w, r, httprouter.Params{})
+		return w.Code
+	}
+	enroll := func(fingerprint, token string) int {
+		return enrollWith(fingerprint, token, "10.0.0.1", `hostname = "node-1"`)
+	}
+
+	assert.Equal(t, 403, enroll("new-node", ""))
+	assert.Equal(t, 403, enroll("new-node", "wrong-token"))
+	assert.Equal(t, 200, enroll("known-node", "test-token"))
+	assert.Empty(t, store.List())
+
+	// Values that could escape the comment in the generated node stanza are rejected
+	assert.Equal(t, 400, enrollWith("new-node", "test-token", "10.0.0.1\n[[node]]", `hostname = "node-1"`))
+	assert.Equal(t, 400, enrollWith("new-node", "test-token", "not-an-ip", `hostname = "node-1"`))
+	assert.Equal(t, 400, enrollWith("new-node", "test-token", "10.0.0.1", `hostname = "node-1\n[[node]]"`))
+	assert.Equal(t, 400, enrollWith("new-node", "test-token", "10.0.0.1", `"host\nname" = "node-1"`))
+	assert.Empty(t, store.List())
+
+	assert.Equal(t, 200, enroll("new-node", "test-token"))
+	require.Len(t, store.List(), 1)
+	assert.Equal(t, "10.0.0.1", store.List()[0].IP)
+	assert.Equal(t, map[string]string{"hostname": "node-1"}, store.List()[0].Facts)
+
+	w := httptest.NewRecorder()
+	newGetPendingNodesHandler(state, store)(w, httptest.NewRequest("GET", "/", nil), httprouter.Params{})
+	assert.Contains(t, w.Body.String(), "new-node,10.0.0.1,")
+	assert.Contains(t, w.Body.String(), ",hostname=node-1\n")
+
+	// Approved nodes are no longer listed
+	inv.NodesByFingerprint["new-node"] = &api.NodeInventory{}
+	w = httptest.NewRecorder()
+	newGetPendingNodesHandler(state, store)(w, httptest.NewRequest("GET", "/", nil), httprouter.Params{})
+	assert.Empty(t, w.Body.String())
+
+	// Nodes only reachable over tunnels may not have an address
+	assert.Equal(t, 200, enrollWith("tunnel-node", "test-token", "", `hostname = "node-2"`))
+	assert.Equal(t, "", store.List()[1].IP)
+}
+
+func TestPendingNodeStore(t *testing.T) {
+	store := newPendingNodeStore()
+	start := time.Now()
+	store.Set(&pendingNode{Fingerprint: "stale", Source: "10.0.0.1", Time: start.Add(-pendingNodeExpiry * 2)})
+
+	// Each source can only hold a few pending nodes - its oldest are evicted
+	for i := 0; i < maxPendingNodesPerSource+1; i++ {
+		store.Set(&pendingNode{Fingerprint: fmt.Sprintf("flood-%d", i), Source: "10.0.0.1", Time: start.Add(time.Duration(i))})
+	}
+	list := store.List()
+	require.Len(t, list, maxPendingNodesPerSource)
+	assert.Equal(t, "flood-1", list[0].Fingerprint)
+
+	// Once the store is full, the oldest node of any source is evicted
+	for i := 0; i < maxPendingNodes; i++ {
+		store.Set(&pendingNode{Fingerprint: fmt.Sprintf("node-%d", i), Source: fmt.Sprintf("10.1.%d.%d", i/256, i%256), Time: start.Add(time.Second + time.Duration(i))})
+	}
+	list = store.List()
+	require.Len(t, list, maxPendingNodes)
+	assert.Equal(t, "node-0", list[0].Fingerprint)
+
+	// Refreshing doesn't evict anything
+	store.Set(&pendingNode{Fingerprint: "node-0", Source: "10.1.0.0", Time: start.Add(time.Minute)})
+	list = store.List()
+	assert.Len(t, list, maxPendingNodes)
+	assert.Equal(t, "node-1", list[0].Fingerprint)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/BurntSushi/toml"
+	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/inventory"
+)
+
+// syncQueue wakes the sync loop and records what asked for the next sync, for the deployment history.
+type syncQueue struct {
+	C       chan struct{}
+	trigger atomic.Pointer[string]
+}
+
+func newSyncQueue() *syncQueue {
+	return &syncQueue{C: make(chan struct{}, 1)}
+}
+
+func (s *syncQueue) Trigger(trigger string) {
+	s.trigger.Store(&trigger)
+	select {
+	case s.C <- struct{}{}:
+	default:
+	}
+}
+
+// Take returns the trigger of the pending sync, defaulting to "poll" when the loop woke up on its own.
+func (s *syncQueue) Take() string {
+	if trigger := s.trigger.Swap(nil); trigger != nil {
+		return *trigger
+	}
+	return "poll"
+}
+
+// maxDeployments is the number of deployments kept in the history file.
+// The file is compacted once it holds twice as many, so most appends don't rewrite it.
+const maxDeployments = 1000
+
+// deploymentHistory persists every inventory swap as a [[deployment]] block appended to a TOML file.
+// The file is only parsed once - later reads are served from memory.
+type deploymentHistory struct {
+	File string
+
+	lock        sync.Mutex
+	loaded      bool
+	deployments []*api.Deployment
+}
+
+func (h *deploymentHistory) Append(d *api.Deployment) error {
+	buf := &bytes.Buffer{}
+	if err := toml.NewEncoder(buf).Encode(&api.DeploymentHistory{Deployments: []*api.Deployment{d}}); err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err := h.load(); err != nil {
+		return err
+	}
+	h.deployments = append(h.deployments, d)
+	if len(h.deployments) >= maxDeployments*2 {
+		return h.compact()
+	}
+
+	f, err := os.OpenFile(h.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(buf.Bytes(), '\n'))
+	return err
+}
+
+// List returns every recorded deployment, oldest first.
+// The deployments are copies, so callers can modify them.
+func (h *deploymentHistory) List() ([]*api.Deployment, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	list := make([]*api.Deployment, len(h.deployments))
+	for i, d := range h.deployments {
+		d := *d
+		list[i] = &d
+	}
+	return list, nil
+}
+
+// Last returns the most recent deployment, or nil if none have been recorded.
+func (h *deploymentHistory) Last() (*api.Deployment, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err := h.load(); err != nil || len(h.deployments) == 0 {
+		return nil, err
+	}
+	last := *h.deployments[len(h.deployments)-1]
+	return &last, nil
+}
+
+func (h *deploymentHistory) load() error {
+	if h.loaded {
+		return nil
+	}
+	history := &api.DeploymentHistory{}
+	if _, err := toml.DecodeFile(h.File, history); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	h.deployments = history.Deployments
+	h.loaded = true
+	return nil
+}
+
+// compact rewrites the history file with only the most recent deployments.
+func (h *deploymentHistory) compact() error {
+	h.deployments = append([]*api.Deployment{}, h.deployments[len(h.deployments)-maxDeployments:]...)
+
+	buf := &bytes.Buffer{}
+	for _, d := range h.deployments {
+		if err := toml.NewEncoder(buf).Encode(&api.DeploymentHistory{Deployments: []*api.Deployment{d}}); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+	}
+
+	tmp := h.File + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.File)
+}
+
+// diffInventories returns the containers added, changed, or removed on each node between two inventories.
+func diffInventories(prev, next *indexedInventory) []*api.NodeChanges {
+	var before, after map[string]*api.NodeInventory
+	if prev != nil {
+		before = prev.NodesByID
+	}
+	if next != nil {
+		after = next.NodesByID
+	}
+	return inventory.Diff(before, after)
+}
+
+// describeCommit returns the author and subject of the given commit.
+func (g *gitSource) describeCommit(sha string) (string, string, error) {
+	out, err := runGit(g.Path, "log", "-1", "--format=%an <%ae>%x00%s", sha)
+	if err != nil {
+		return "", "", err
+	}
+	author, subject, _ := strings.Cut(out, "\x00")
+	return author, subject, nil
+}
+
+// newGetHistoryHandler returns the most recent deployments (up to the `limit` query param), oldest first.
+// Changes to nodes and containers outside of the caller's scope are omitted.
+func newGetHistoryHandler(history *deploymentHistory) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		limit := 20
+		if str := r.URL.Query().Get("limit"); str != "" {
+			var err error
+			limit, err = strconv.Atoi(str)
+			if err != nil || limit < 1 {
+				http.Error(w, "invalid limit", 400)
+				return
+			}
+		}
+
+		deployments, err := history.List()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("reading history: %s", err), 500)
+			return
+		}
+		if len(deployments) > limit {
+			deployments = deployments[len(deployments)-limit:]
+		}
+
+		grant := requestGrant(r)
+		if grant.Scoped() {
+			for _, d := range deployments {
+				d.Nodes = scopeNodeChanges(grant, d.Nodes)
+			}
+		}
+
+		toml.NewEncoder(w).Encode(&api.DeploymentHistory{Deployments: deployments})
+	}
+}
+
+func scopeNodeChanges(grant *clientGrant, changes []*api.NodeChanges) []*api.NodeChanges {
+	filter := func(node string, names []string) []string {
+		allowed := []string{}
+		for _, name := range names {
+			if grant.Allows(node, name) {
+				allowed = append(allowed, name)
+			}
+		}
+		return allowed
+	}
+
+	scoped := []*api.NodeChanges{}
+	for _, c := range changes {
+		c = &api.NodeChanges{Node: c.Node, Added: filter(c.Node, c.Added), Changed: filter(c.Node, c.Changed), Removed: filter(c.Node, c.Removed)}
+		if len(c.Added)+len(c.Changed)+len(c.Removed) > 0 {
+			scoped = append(scoped, c)
+		}
+	}
+	return scoped
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/concurrency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncInventoryHistory(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cluster.toml"), []byte("[[node]]\nname = 'node-1'\ncontainers = ['test.toml']\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test.toml"), []byte("image = 'test:1'"), 0644))
+
+	source := &dirSource{Path: dir}
+	state := &concurrency.StateContainer[*indexedInventory]{}
+	history := &deploymentHistory{File: filepath.Join(t.TempDir(), "history.toml")}
+
+	require.NoError(t, syncInventory(source, state, newNodeMetadataStore(), history, &digestTracker{}, "startup"))
+	require.NoError(t, syncInventory(source, state, newNodeMetadataStore(), history, &digestTracker{}, "poll")) // no changes
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test.toml"), []byte("image = 'test:2'"), 0644))
+	require.NoError(t, syncInventory(source, state, newNodeMetadataStore(), history, &digestTracker{}, "webhook"))
+
+	deployments, err := history.List()
+	require.NoError(t, err)
+	require.Len(t, deployments, 2)
+
+	// The previous inventory isn't known at startup, so nothing is diffed
+	assert.Equal(t, "startup", deployments[0].Trigger)
+	assert.Empty(t, deployments[0].Nodes)
+	assert.Equal(t, "webhook", deployments[1].Trigger)
+	assert.Equal(t, state.Get().GitSHA, deployments[1].Version)
+	assert.Equal(t, []*api.NodeChanges{{Node: "node-1", Changed: []string{"test"}}}, deployments[1].Nodes)
+
+	// Restarting without changes doesn't record another deployment
+	restarted := &concurrency.StateContainer[*indexedInventory]{}
+	history = &deploymentHistory{File: history.File}
+	require.NoError(t, syncInventory(source, restarted, newNodeMetadataStore(), history, &digestTracker{}, "startup"))
+	deployments, err = history.List()
+	require.NoError(t, err)
+	assert.Len(t, deployments, 2)
+}
+
+func TestDeploymentHistoryCompaction(t *testing.T) {
+	history := &deploymentHistory{File: filepath.Join(t.TempDir(), "history.toml")}
+	for i := 0; i < maxDeployments*2; i++ {
+		require.NoError(t, history.Append(&api.Deployment{Version: strconv.Itoa(i), Time: time.Now(), Trigger: "poll"}))
+	}
+
+	// Reload from disk
+	history = &deploymentHistory{File: history.File}
+	deployments, err := history.List()
+	require.NoError(t, err)
+	require.Len(t, deployments, maxDeployments)
+	assert.Equal(t, strconv.Itoa(maxDeployments), deployments[0].Version)
+	assert.Equal(t, strconv.Itoa(maxDeployments*2-1), deployments[maxDeployments-1].Version)
+
+	// Modifying listed deployments doesn't modify the history
+	deployments[0].Version = "modified"
+	last, err := history.Last()
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(maxDeployments*2-1), last.Version)
+	deployments, err = history.List()
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(maxDeployments), deployments[0].Version)
+}
+
+func TestGetHistoryHandler(t *testing.T) {
+	history := &deploymentHistory{File: filepath.Join(t.TempDir(), "history.toml")}
+	for _, version := range []string{"1", "2", "3"} {
+		require.NoError(t, history.Append(&api.Deployment{Version: version, Time: time.Now(), Trigger: "poll", Nodes: []*api.NodeChanges{
+			{Node: "node-1", Added: []string{"nginx", "postgres"}},
+			{Node: "node-2", Removed: []string{"nginx"}},
+		}}))
+	}
+	fn := newGetHistoryHandler(history)
+
+	get := func(url string, grant *clientGrant) *api.DeploymentHistory {
+		r := httptest.NewRequest("GET", url, nil)
+		if grant != nil {
+			r = r.WithContext(context.WithValue(r.Context(), grantKey{}, grant))
+		}
+		w := httptest.NewRecorder()
+		fn(w, r, httprouter.Params{})
+		require.Equal(t, 200, w.Code)
+
+		resp := &api.DeploymentHistory{}
+		_, err := toml.Decode(w.Body.String(), resp)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := get("/?limit=2", nil)
+	require.Len(t, resp.Deployments, 2)
+	assert.Equal(t, "2", resp.Deployments[0].Version)
+	assert.Equal(t, "3", resp.Deployments[1].Version)
+	assert.Len(t, resp.Deployments[1].Nodes, 2)
+
+	scoped := &clientGrant{Role: roleViewer, Containers: map[string]struct{}{"postgres": {}}}
+	resp = get("/", scoped)
+	require.Len(t, resp.Deployments, 3)
+	assert.Equal(t, []*api.NodeChanges{{Node: "node-1", Added: []string{"postgres"}}}, resp.Deployments[0].Nodes)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/csv"
 	"encoding/hex"
 	"fmt"
@@ -12,7 +13,6 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,32 +20,56 @@ import (
 
 	"github.com/BurntSushi/toml"
 	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/api"
 	"github.com/jveski/recompose/internal/rpc"
 )
 
-func newPublicHandler(hookKey []byte, hookSignal chan<- struct{}) http.Handler {
+func newPublicHandler(hookKey []byte, hookSignal *syncQueue) http.Handler {
 	router := httprouter.New()
 	router.POST("/hook", newWebhookHandler(hookKey, hookSignal))
 	return router
 }
 
-func newApiHandler(state inventoryContainer, nodeStore *nodeMetadataStore, client *rpc.Client, statusTimeout time.Duration) http.Handler {
+func newApiHandler(state inventoryContainer, nodeStore *nodeMetadataStore, client *rpc.Client, statusTimeout time.Duration, secrets map[string]secretBackend, ca *rpc.CAAuthorizer, issuer *loginIssuer, pending *pendingNodeStore, joinToken []byte, tunnels *rpc.TunnelPool, source inventorySource, syncSignal *syncQueue, syncStatus syncStatusContainer, history *deploymentHistory, images *imageArchiveStore) http.Handler {
 	var (
-		router     = httprouter.New()
-		agentAuth  = &agentAuthorizer{Container: state}
-		clientAuth = &clientAuthorizer{Container: state}
+		router    = httprouter.New()
+		agentAuth = &agentAuthorizer{Container: state, CA: ca}
+		policy    = &clientPolicy{Container: state, CA: ca, Logins: issuer.Authorizer()}
+		anyCert   = rpc.AuthorizerFunc(func(string) bool { return true })
 	)
 
 	router.GET("/nodeinventory", rpc.WithAuth(agentAuth, newGetNodeInventoryHandler(state)))
-	router.POST("/decrypt", rpc.WithAuth(agentAuth, newDecryptHandler()))
-	router.POST("/registernode", rpc.WithAuth(agentAuth, newRegisterNodeHandler(nodeStore)))
-	router.GET("/nodes/:fingerprint/logs", rpc.WithAuth(clientAuth, newProxyHandler(nodeStore, client, "/logs")))
-	router.GET("/status", rpc.WithAuth(clientAuth, newGetStatusHandler(nodeStore, client, statusTimeout)))
+	router.POST("/decrypt", rpc.WithAuth(agentAuth, newDecryptHandler(secrets)))
+	router.POST("/registernode", rpc.WithAuth(agentAuth, newRegisterNodeHandler(state, nodeStore)))
+	router.GET("/tunnel", rpc.WithAuth(agentAuth, newTunnelHandler(tunnels)))
+	router.GET("/images/:digest", rpc.WithAuth(agentAuth, newGetImageHandler(state, nodeStore, images)))
+	router.GET("/nodes/:fingerprint/logs", withPolicy(policy, roleOperator, withContainerScope(newProxyHandler(nodeStore, client, "/logs"))))
+	router.GET("/status", withPolicy(policy, roleViewer, newGetStatusHandler(nodeStore, client, statusTimeout)))
+	router.GET("/sync", withPolicy(policy, roleViewer, newGetSyncStatusHandler(state, syncStatus, source)))
+	router.GET("/history", withPolicy(policy, roleViewer, newGetHistoryHandler(history)))
+	router.GET("/pending", withPolicy(policy, roleAdmin, newGetPendingNodesHandler(state, pending)))
+
+	if git, ok := source.(*gitSource); ok {
+		router.POST("/pin", withPolicy(policy, roleAdmin, newPinHandler(state, git, syncSignal)))
+		router.DELETE("/pin", withPolicy(policy, roleAdmin, newUnpinHandler(git, syncSignal)))
+	}
+
+	// Tarballs can only be pushed when the coordinator isn't syncing from some other source
+	if push, ok := source.(*pushSource); ok {
+		router.POST("/push", withPolicy(policy, roleAdmin, newPushHandler(push, syncSignal)))
+	}
+
+	// Agents that aren't in the inventory yet can ask to join the cluster
+	router.POST("/enroll", rpc.WithAuth(anyCert, newEnrollHandler(state, pending, joinToken)))
+
+	// Login authenticates callers itself since untrusted clients can log in using the bootstrap token.
+	// Certs issued by previous logins aren't trusted here, otherwise they could be renewed indefinitely.
+	router.POST("/login", rpc.WithAuth(anyCert, newLoginHandler(issuer, &clientPolicy{Container: state, CA: ca})))
 
 	return router
 }
 
-func newWebhookHandler(key []byte, signal chan<- struct{}) httprouter.Handle {
+func newWebhookHandler(key []byte, signal *syncQueue) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		hash := hmac.New(sha256.New, key)
 		io.Copy(hash, r.Body)
@@ -56,10 +80,7 @@ func newWebhookHandler(key []byte, signal chan<- struct{}) httprouter.Handle {
 			return
 		}
 
-		select {
-		case signal <- struct{}{}:
-		default:
-		}
+		signal.Trigger("webhook")
 	}
 }
 
@@ -88,7 +109,7 @@ func newGetNodeInventoryHandler(state inventoryContainer) httprouter.Handle {
 			}
 
 			state := state.Get()
-			nodeinv := state.NodesByFingerprint[q.Get("fingerprint")]
+			nodeinv := state.Node(q.Get("fingerprint"), q.Get("name"))
 			if after == "" || (state != nil && state.GitSHA != after) {
 				inventoryResponseLock.Lock()
 				defer inventoryResponseLock.Unlock()
@@ -103,32 +124,60 @@ func newGetNodeInventoryHandler(state inventoryContainer) httprouter.Handle {
 	}
 }
 
-func newDecryptHandler() httprouter.Handle {
+func newDecryptHandler(backends map[string]secretBackend) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		cmd := exec.CommandContext(r.Context(), "age", "--decrypt", "--identity=identity.txt")
-		cmd.Stdin = r.Body
-		out, err := cmd.CombinedOutput()
+		provider := r.URL.Query().Get("provider")
+		if provider == "" {
+			provider = "age"
+		}
+		backend, ok := backends[provider]
+		if !ok {
+			http.Error(w, "unknown secret provider", 400)
+			return
+		}
+
+		ciphertext, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+
+		out, err := backend.Decrypt(r.Context(), ciphertext)
 		if err != nil {
-			log.Printf("error while decrypting secret: %s - %s", err, out)
+			log.Printf("error while decrypting secret using provider %q: %s", provider, err)
 			w.WriteHeader(500)
 			return
 		}
-		w.Write(out[:len(out)-1]) // trim off trailing newline
+		w.Write(out)
 	}
 }
 
-func newRegisterNodeHandler(store *nodeMetadataStore) httprouter.Handle {
+func newRegisterNodeHandler(state inventoryContainer, store *nodeMetadataStore) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		q := r.URL.Query()
 		fingerprint := q.Get("fingerprint")
+		if name := q.Get("name"); name != "" {
+			fingerprint = name // CA-issued certs are identified by name since their fingerprint changes when renewed
+		}
 		apiport, _ := strconv.Atoi(q.Get("apiport"))
 		meta := &nodeMetadata{
 			Fingerprint: fingerprint,
-			IP:          q.Get("ip"),
+			IPs:         q["ip"],
 			APIPort:     uint(apiport),
+			Trusts:      q["trusts"],
+		}
+		if platform := q.Get("platform"); platformPattern.MatchString(platform) {
+			meta.Platform = platform
 		}
 		store.Set(fingerprint, meta)
-		log.Printf("received metadata for node: %s - ip=%s apiport=%d", fingerprint, meta.IP, meta.APIPort)
+		log.Printf("received metadata for node: %s - ip=%s apiport=%d", fingerprint, strings.Join(meta.IPs, ","), meta.APIPort)
+
+		// Nodes that have rotated their cert shouldn't also be reachable by the previous fingerprint
+		if inv := state.Get(); inv != nil {
+			for _, sibling := range inv.SiblingFingerprints(fingerprint) {
+				store.Delete(sibling)
+			}
+		}
 
 		<-r.Context().Done()
 	}
@@ -138,18 +187,15 @@ func newProxyHandler(store *nodeMetadataStore, client *rpc.Client, upstreamPath
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		fingerprint := p.ByName("fingerprint")
 
-		metadata := store.Get(fingerprint)
-		if metadata == nil || metadata.APIPort == 0 {
+		if store.Get(fingerprint) == nil {
 			http.Error(w, "node with the given fingerprint is not known", 400)
 			return
 		}
 
 		r.URL.Path = upstreamPath
 
-		upstream := &url.URL{
-			Scheme: "https",
-			Host:   fmt.Sprintf("%s:%d", metadata.IP, metadata.APIPort),
-		}
+		// The client dials the node using its tunnel or registered address
+		upstream := &url.URL{Scheme: "https", Host: fingerprint}
 		proxy := httputil.NewSingleHostReverseProxy(upstream)
 		proxy.Transport = client.Transport
 		proxy.ServeHTTP(w, r)
@@ -159,6 +205,7 @@ func newProxyHandler(store *nodeMetadataStore, client *rpc.Client, upstreamPath
 func newGetStatusHandler(store *nodeMetadataStore, client *rpc.Client, timeout time.Duration) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		resp := [][]string{}
+		grant := requestGrant(r)
 
 		var partial bool
 		for _, node := range store.List() {
@@ -168,7 +215,11 @@ func newGetStatusHandler(store *nodeMetadataStore, client *rpc.Client, timeout t
 				partial = true
 				continue
 			}
-			resp = append(resp, rows...)
+			for _, row := range rows {
+				if grant.Allows(node.Fingerprint, row[0]) {
+					resp = append(resp, row)
+				}
+			}
 		}
 
 		if partial {
@@ -179,11 +230,29 @@ func newGetStatusHandler(store *nodeMetadataStore, client *rpc.Client, timeout t
 	}
 }
 
+// newGetSyncStatusHandler reports the result of the last attempt to sync the inventory,
+// since failed syncs (i.e. unsigned commits) leave the previous inventory in place.
+func newGetSyncStatusHandler(state inventoryContainer, status syncStatusContainer, source inventorySource) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		resp := api.SyncStatus{}
+		if current := status.Get(); current != nil {
+			resp = *current
+		}
+		if inv := state.Get(); inv != nil {
+			resp.Version = inv.GitSHA
+		}
+		if git, ok := source.(*gitSource); ok {
+			resp.Pinned = git.Pinned()
+		}
+		toml.NewEncoder(w).Encode(&resp)
+	}
+}
+
 func getAgentStatus(ctx context.Context, client *rpc.Client, timeout time.Duration, node *nodeMetadata) (rows [][]string, err error) {
 	ctx, done := context.WithTimeout(ctx, timeout)
 	defer done()
 
-	resp, err := client.GET(ctx, fmt.Sprintf("https://%s:%d/ps", node.IP, node.APIPort))
+	resp, err := client.GET(ctx, fmt.Sprintf("https://%s/ps", node.Fingerprint))
 	if err != nil {
 		return nil, err
 	}
@@ -207,6 +276,7 @@ func getAgentStatus(ctx context.Context, client *rpc.Client, timeout time.Durati
 
 type agentAuthorizer struct {
 	Container inventoryContainer
+	CA        *rpc.CAAuthorizer // optional
 }
 
 func (a *agentAuthorizer) TrustsCert(fingerprint string) bool {
@@ -214,15 +284,14 @@ func (a *agentAuthorizer) TrustsCert(fingerprint string) bool {
 	return state != nil && state.NodesByFingerprint[fingerprint] != nil
 }
 
-type clientAuthorizer struct {
-	Container inventoryContainer
-}
-
-func (a *clientAuthorizer) TrustsCert(fingerprint string) bool {
-	state := a.Container.Get()
-	if state == nil {
-		return false
+func (a *agentAuthorizer) TrustsCertificate(chain []*x509.Certificate) (string, bool) {
+	if a.CA == nil {
+		return "", false
+	}
+	name, err := a.CA.Verify(chain)
+	if err != nil {
+		return "", false
 	}
-	_, ok := state.ClientsByFingerprint[fingerprint]
-	return ok
+	state := a.Container.Get()
+	return name, state != nil && state.NodesByName[name] != nil
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -11,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/julienschmidt/httprouter"
 	"github.com/jveski/recompose/internal/api"
 	"github.com/jveski/recompose/internal/concurrency"
@@ -21,7 +23,7 @@ import (
 
 func TestWebhookHappyPath(t *testing.T) {
 	testKey := []byte("test key")
-	signal := make(chan struct{}, 1)
+	signal := newSyncQueue()
 	fn := newWebhookHandler(testKey, signal)
 
 	w := httptest.NewRecorder()
@@ -30,12 +32,14 @@ func TestWebhookHappyPath(t *testing.T) {
 	fn(w, r, httprouter.Params{})
 	assert.Equal(t, 200, w.Code)
 
-	<-signal
+	<-signal.C
+	assert.Equal(t, "webhook", signal.Take())
+	assert.Equal(t, "poll", signal.Take())
 }
 
 func TestWebhook401(t *testing.T) {
 	testKey := []byte("test invalidkey")
-	signal := make(chan struct{}, 1)
+	signal := newSyncQueue()
 	fn := newWebhookHandler(testKey, signal)
 
 	w := httptest.NewRecorder()
@@ -49,7 +53,7 @@ func TestGetNodeInventoryHappyPath(t *testing.T) {
 	state := &concurrency.StateContainer[*indexedInventory]{}
 
 	state.Swap(&indexedInventory{
-		ClientsByFingerprint: map[string]struct{}{},
+		ClientsByFingerprint: map[string]*clientGrant{},
 		NodesByFingerprint: map[string]*api.NodeInventory{
 			"test": {GitSHA: "test-sha"},
 		},
@@ -64,14 +68,21 @@ func TestGetNodeInventoryHappyPath(t *testing.T) {
 }
 
 func TestRegisterNode(t *testing.T) {
+	nodeInv := &api.NodeInventory{}
+	state := &concurrency.StateContainer[*indexedInventory]{}
+	state.Swap(&indexedInventory{
+		NodesByFingerprint: map[string]*api.NodeInventory{"test1": nodeInv, "test1-prev": nodeInv},
+	})
+
 	store := newNodeMetadataStore()
-	fn := newRegisterNodeHandler(store)
+	store.Set("test1-prev", &nodeMetadata{})
+	fn := newRegisterNodeHandler(state, store)
 
 	ctx, done := context.WithCancel(context.Background())
 	done()
 
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest("POST", "/?fingerprint=test1&apiport=123&ip=234", nil)
+	r := httptest.NewRequest("POST", "/?fingerprint=test1&apiport=123&ip=234&ip=fd00::1&trusts=coord1&trusts=coord2&platform=linux/arm64", nil)
 	r = r.WithContext(ctx)
 	fn(w, r, httprouter.Params{})
 	assert.Equal(t, 200, w.Code)
@@ -79,7 +90,11 @@ func TestRegisterNode(t *testing.T) {
 	actual := store.Get("test1")
 	require.NotNil(t, actual)
 	assert.Equal(t, uint(123), actual.APIPort)
-	assert.Equal(t, "234", actual.IP)
+	assert.Equal(t, []string{"234", "fd00::1"}, actual.IPs)
+	assert.True(t, actual.TrustsAll("coord1", "coord2"))
+	assert.False(t, actual.TrustsAll("coord3"))
+	assert.Equal(t, "linux/arm64", actual.Platform)
+	assert.Nil(t, store.Get("test1-prev"))
 }
 
 func TestGetStatusHappyPath(t *testing.T) {
@@ -94,13 +109,13 @@ func TestGetStatusHappyPath(t *testing.T) {
 	require.NoError(t, err)
 
 	store := newNodeMetadataStore()
-	store.Set("test", &nodeMetadata{
+	store.Set("test-fingerprint", &nodeMetadata{
 		Fingerprint: "test-fingerprint",
-		IP:          "127.0.0.1",
+		IPs:         []string{"127.0.0.1"},
 		APIPort:     uint(port),
 	})
 
-	client := &rpc.Client{Client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}}
+	client := newTestAgentClient(store, "test-fingerprint")
 	fn := newGetStatusHandler(store, client, time.Second*10)
 
 	w := httptest.NewRecorder()
@@ -122,13 +137,13 @@ func TestGetStatusTimeout(t *testing.T) {
 	require.NoError(t, err)
 
 	store := newNodeMetadataStore()
-	store.Set("test", &nodeMetadata{
+	store.Set("test-fingerprint", &nodeMetadata{
 		Fingerprint: "test-fingerprint",
-		IP:          "127.0.0.1",
+		IPs:         []string{"127.0.0.1"},
 		APIPort:     uint(port),
 	})
 
-	client := &rpc.Client{Client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}}
+	client := newTestAgentClient(store, "test-fingerprint")
 	fn := newGetStatusHandler(store, client, time.Millisecond)
 
 	w := httptest.NewRecorder()
@@ -136,3 +151,78 @@ func TestGetStatusTimeout(t *testing.T) {
 	fn(w, r, httprouter.Params{})
 	assert.Equal(t, 206, w.Code)
 }
+
+func TestGetSyncStatus(t *testing.T) {
+	state := &concurrency.StateContainer[*indexedInventory]{}
+	state.Swap(newIndexedInventory("test-sha"))
+	status := &concurrency.StateContainer[*api.SyncStatus]{}
+	fn := newGetSyncStatusHandler(state, status, &dirSource{})
+
+	get := func() *api.SyncStatus {
+		w := httptest.NewRecorder()
+		fn(w, httptest.NewRequest("GET", "/", nil), httprouter.Params{})
+		require.Equal(t, 200, w.Code)
+
+		resp := &api.SyncStatus{}
+		_, err := toml.Decode(w.Body.String(), resp)
+		require.NoError(t, err)
+		return resp
+	}
+
+	assert.Equal(t, &api.SyncStatus{Version: "test-sha"}, get())
+
+	recordSync(status, errors.New("test error"))
+	resp := get()
+	assert.Equal(t, "test-sha", resp.Version)
+	assert.Equal(t, "test error", resp.Error)
+	assert.False(t, resp.Time.IsZero())
+
+	recordSync(status, nil)
+	assert.Empty(t, get().Error)
+}
+
+func TestDecrypt(t *testing.T) {
+	fn := newDecryptHandler(map[string]secretBackend{
+		"exec": &execBackend{Command: []string{"cat"}},
+	})
+
+	t.Run("happy path", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/?provider=exec", bytes.NewBufferString("test-ciphertext"))
+		fn(w, r, httprouter.Params{})
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "test-ciphertext", w.Body.String())
+	})
+
+	t.Run("unknown provider", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", bytes.NewBufferString("test-ciphertext"))
+		fn(w, r, httprouter.Params{})
+		assert.Equal(t, 400, w.Code)
+	})
+}
+
+// newTestAgentClient returns a client that reaches the given node using its registered IP and port.
+func newTestAgentClient(store *nodeMetadataStore, fingerprint string) *rpc.Client {
+	state := &concurrency.StateContainer[*indexedInventory]{}
+	inv := newIndexedInventory("")
+	inv.NodesByFingerprint[fingerprint] = &api.NodeInventory{}
+	state.Swap(inv)
+
+	config := &tls.Config{InsecureSkipVerify: true}
+	dialer := &agentDialer{Container: state, Store: store, Tunnels: rpc.NewTunnelPool(), TLS: config}
+	return &rpc.Client{Client: &http.Client{Transport: &http.Transport{TLSClientConfig: config, DialTLSContext: dialer.DialTLSContext}}}
+}
+
+func TestDialTimeout(t *testing.T) {
+	assert.Equal(t, agentDialTimeout, dialTimeout(context.Background(), 3))
+
+	ctx, done := context.WithTimeout(context.Background(), time.Minute)
+	defer done()
+	assert.InDelta(t, float64(time.Second*20), float64(dialTimeout(ctx, 3)), float64(time.Second))
+	assert.InDelta(t, float64(time.Minute), float64(dialTimeout(ctx, 1)), float64(time.Second))
+
+	ctx, done = context.WithTimeout(context.Background(), time.Second)
+	defer done()
+	assert.Equal(t, minAgentDialTimeout, dialTimeout(ctx, 2))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/inventory"
+)
+
+var (
+	digestPattern   = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+	platformPattern = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9]+(/[a-z0-9]+)?$`)
+)
+
+// imageArchiveStore holds image archives served to agents that can't reach a registry.
+// Archives can be added to Dir by hand as <digest>.tar i.e. using `podman save --format=oci-archive`, and are served to every platform.
+// Otherwise the coordinator pulls the image for the node's platform and saves it as <digest>-<os>-<arch>.tar the first time it's requested.
+type imageArchiveStore struct {
+	Dir     string
+	Secrets map[string]secretBackend // decrypts the credentials of registries declared in cluster.toml
+	lock    sync.Mutex               // serializes pulls
+}
+
+// Get returns the path of the image's archive, pulling and saving the image first if it hasn't been archived yet.
+// The registry's credentials are used for the pull when given.
+func (s *imageArchiveStore) Get(ctx context.Context, image, digest, platform string, registry *api.Registry) (string, error) {
+	if path := filepath.Join(s.Dir, digest+".tar"); fileExists(path) {
+		return path, nil
+	}
+	path := filepath.Join(s.Dir, digest+"-"+strings.ReplaceAll(platform, "/", "-")+".tar")
+	if fileExists(path) {
+		return path, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if fileExists(path) {
+		return path, nil // saved while waiting for the lock
+	}
+
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	ref := inventory.ParseImage(image).Name + "@" + digest
+	args := []string{"pull", "--quiet", "--platform=" + platform}
+	if registry != nil {
+		authFile, err := s.writeAuthFile(ctx, registry)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(authFile)
+		args = append(args, "--authfile="+authFile)
+	}
+	if err := runPodman(ctx, append(args, ref)...); err != nil {
+		return "", fmt.Errorf("pulling image: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	defer os.Remove(tmp)
+	if err := runPodman(ctx, "save", "--format=oci-archive", "--output="+tmp, ref); err != nil {
+		return "", fmt.Errorf("saving image: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+
+	log.Printf("archived image %s (%s) in %s", ref, platform, time.Since(start))
+	return path, nil
+}
+
+// writeAuthFile writes the registry's decrypted credentials to a temporary file read by `podman pull --authfile`.
+// Callers must remove the file once the pull is done.
+func (s *imageArchiveStore) writeAuthFile(ctx context.Context, registry *api.Registry) (string, error) {
+	username, password, err := decryptRegistryCredentials(ctx, s.Secrets, registry)
+	if err != nil {
+		return "", err
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	buf, err := json.Marshal(map[string]any{"auths": map[string]any{registry.Hostname: map[string]string{"auth": auth}}})
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp("", "recompose-auth-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func runPodman(ctx context.Context, args ...string) error {
+	out, err := exec.CommandContext(ctx, "podman", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("podman error: %s", bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// findImage returns the image of the node's container pinned to the given digest, or an empty string if there isn't one.
+func findImage(node *api.NodeInventory, digest string) string {
+	if node == nil {
+		return ""
+	}
+	for _, container := range node.Containers {
+		if container.ImageDigest == digest || inventory.ParseImage(container.Image).Digest == digest {
+			return container.Image
+		}
+	}
+	return ""
+}
+
+// newGetImageHandler serves the archive of an image used by the requesting agent's containers.
+// The image is pulled for the platform the agent registered with.
+func newGetImageHandler(state inventoryContainer, nodes *nodeMetadataStore, store *imageArchiveStore) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		digest := p.ByName("digest")
+		if !digestPattern.MatchString(digest) {
+			http.Error(w, "invalid digest", 400)
+			return
+		}
+
+		q := r.URL.Query()
+		node := state.Get().Node(q.Get("fingerprint"), q.Get("name"))
+		image := findImage(node, digest)
+		if image == "" {
+			http.Error(w, "image isn't used by any of the node's containers", 404)
+			return
+		}
+
+		// Node metadata is keyed the same way as tunnels: by name for CA-issued certs, otherwise by fingerprint
+		key := q.Get("fingerprint")
+		if name := q.Get("name"); name != "" {
+			key = name
+		}
+		meta := nodes.Get(key)
+		if meta == nil || meta.Platform == "" {
+			http.Error(w, "the node hasn't registered its platform yet", 503)
+			return
+		}
+
+		path, err := store.Get(r.Context(), image, digest, meta.Platform, findRegistry(node, image))
+		if err != nil {
+			log.Printf("error while archiving image %s@%s: %s", image, digest, err)
+			w.WriteHeader(500)
+			return
+		}
+		http.ServeFile(w, r, path)
+	}
+}
+
+// findRegistry returns the credentials of the registry hosting the image, or nil if it doesn't have any.
+func findRegistry(node *api.NodeInventory, image string) *api.Registry {
+	hostname := inventory.ParseImage(image).Registry
+	for _, registry := range node.Registries {
+		if registry.Hostname == hostname {
+			return registry
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/concurrency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetImageHandler(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	other := "sha256:" + strings.Repeat("b", 64)
+	multiArch := "sha256:" + strings.Repeat("c", 64)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, digest+".tar"), []byte("test-archive"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, other+".tar"), []byte("other-archive"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, multiArch+"-linux-arm64.tar"), []byte("arm64-archive"), 0644))
+
+	inv := newIndexedInventory("")
+	inv.NodesByFingerprint["test-node"] = &api.NodeInventory{Containers: []*api.ContainerSpec{
+		{Name: "tracked", Image: "nginx:latest", ImageDigest: digest},
+		{Name: "static", Image: "nginx:1"},
+		{Name: "multi-arch", Image: "postgres:latest", ImageDigest: multiArch},
+	}}
+	inv.NodesByFingerprint["unregistered-node"] = inv.NodesByFingerprint["test-node"]
+	state := &concurrency.StateContainer[*indexedInventory]{}
+	state.Swap(inv)
+	nodes := newNodeMetadataStore()
+	nodes.Set("test-node", &nodeMetadata{Fingerprint: "test-node", Platform: "linux/arm64"})
+	fn := newGetImageHandler(state, nodes, &imageArchiveStore{Dir: dir})
+
+	get := func(digest, fingerprint string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/images/"+digest+"?fingerprint="+fingerprint, nil)
+		fn(w, r, httprouter.Params{{Key: "digest", Value: digest}})
+		return w
+	}
+
+	t.Run("happy path", func(t *testing.T) {
+		w := get(digest, "test-node")
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "test-archive", w.Body.String())
+	})
+
+	t.Run("pulled for the node's platform", func(t *testing.T) {
+		w := get(multiArch, "test-node")
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "arm64-archive", w.Body.String())
+	})
+
+	t.Run("platform not registered", func(t *testing.T) {
+		assert.Equal(t, 503, get(multiArch, "unregistered-node").Code)
+	})
+
+	t.Run("not used by the node", func(t *testing.T) {
+		assert.Equal(t, 404, get(other, "test-node").Code)
+		assert.Equal(t, 404, get(digest, "another-node").Code)
+	})
+
+	t.Run("invalid digest", func(t *testing.T) {
+		assert.Equal(t, 400, get("../../etc/passwd", "test-node").Code)
+	})
+}
+
+func TestImageArchiveAuthFile(t *testing.T) {
+	secretsDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(secretsDir, "username"), []byte("test-user"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(secretsDir, "password"), []byte("test-password"), 0644))
+	store := &imageArchiveStore{Dir: t.TempDir(), Secrets: map[string]secretBackend{"file": &fileBackend{Dir: secretsDir}}}
+
+	file, err := store.writeAuthFile(context.Background(), &api.Registry{Hostname: "ghcr.io", Username: "username", Password: "password", Provider: "file"})
+	require.NoError(t, err)
+	defer os.Remove(file)
+
+	buf, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"auths": {"ghcr.io": {"auth": "dGVzdC11c2VyOnRlc3QtcGFzc3dvcmQ="}}}`, string(buf))
+
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	_, err = store.writeAuthFile(context.Background(), &api.Registry{Hostname: "ghcr.io", Provider: "nope"})
+	assert.EqualError(t, err, `unknown secret provider "nope"`)
+}
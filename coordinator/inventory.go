@@ -1,70 +1,159 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"bytes"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/BurntSushi/toml"
-
 	"github.com/jveski/recompose/internal/api"
 	"github.com/jveski/recompose/internal/concurrency"
+	"github.com/jveski/recompose/internal/inventory"
 )
 
 type inventoryContainer = *concurrency.StateContainer[*indexedInventory]
 
-func syncInventory(dir string, state inventoryContainer, nms *nodeMetadataStore) error {
-	sha, err := gitPull(dir)
+type syncStatusContainer = *concurrency.StateContainer[*api.SyncStatus]
+
+// recordSync stores the result of an attempt to sync the inventory so it can be reported by the API.
+func recordSync(status syncStatusContainer, err error) {
+	result := &api.SyncStatus{Time: time.Now()}
 	if err != nil {
-		return fmt.Errorf("pulling git repo: %w", err)
+		result.Error = err.Error()
 	}
+	status.Swap(result)
+}
 
-	if current := state.Get(); current != nil && current.GitSHA == sha {
+// syncInventory swaps in the latest version of the inventory (when it has changed) and records it in the deployment history.
+// Tracked images are pinned to their latest digest, so the inventory is also swapped when the digests change.
+func syncInventory(source inventorySource, state inventoryContainer, nms *nodeMetadataStore, history *deploymentHistory, tracker *digestTracker, trigger string) error {
+	version, err := source.Sync()
+	if err != nil {
+		return err
+	}
+
+	current := state.Get()
+	if current != nil && current.GitSHA == version && current.Digests == tracker.Version() {
 		return nil // already in sync
 	}
-	log.Printf("pulled git SHA: %s", sha)
+	log.Printf("synced inventory version: %s (trigger: %s)", version, trigger)
 
-	inv := newIndexedInventory(sha)
-	err = readInventory(dir, inv, nms)
+	inv := newIndexedInventory(version)
+	err = readInventory(source.Dir(), inv, nms)
 	if err != nil {
 		return fmt.Errorf("reading inventory: %w", err)
 	}
+	tracker.Apply(inv)
 
 	state.Swap(inv)
+
+	// The previous inventory isn't known after restarting, so the first deployment isn't diffed.
+	// It's only recorded when the version differs from the last recorded deployment.
+	deployment := &api.Deployment{Version: version, Time: time.Now(), Trigger: trigger}
+	if current != nil {
+		deployment.Nodes = diffInventories(current, inv)
+	} else if last, err := history.Last(); err != nil {
+		log.Printf("error while reading deployment history: %s", err)
+	} else if last != nil && last.Version == version {
+		return nil
+	}
+	if git, ok := source.(*gitSource); ok {
+		deployment.Author, deployment.Message, err = git.describeCommit(version)
+		if err != nil {
+			log.Printf("error while describing commit %s: %s", version, err)
+		}
+	}
+	if err := history.Append(deployment); err != nil {
+		log.Printf("error while recording deployment history: %s", err)
+	}
 	return nil
 }
 
-func gitPull(dir string) (string /* sha */, error) {
+// gitFetch fetches the given ref (or the upstream of the current branch) and returns the SHA of its commit.
+func gitFetch(dir, ref string) (string /* sha */, error) {
 	start := time.Now()
-	cmd := exec.Command("git", "pull")
+	target := "@{upstream}"
+	args := []string{"fetch", "--quiet", "origin"}
+	if ref != "" {
+		target = "FETCH_HEAD"
+		args = append(args, "--force", ref)
+	}
+	if _, err := runGit(dir, args...); err != nil {
+		return "", err
+	}
+	log.Printf("fetched git repo in %s", time.Since(start))
+
+	return runGit(dir, "rev-parse", "--verify", target+"^{commit}")
+}
+
+// gitCheckout hard resets the working tree to the given commit.
+// Resetting rather than pulling means local changes can't cause merge conflicts that block syncing.
+func gitCheckout(dir, sha string) error {
+	for _, args := range [][]string{{"reset", "--quiet", "--hard", sha}, {"clean", "--quiet", "-fd"}} {
+		if _, err := runGit(dir, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gitVerifyCommit returns an error unless the commit is signed by an SSH key listed in the allowed signers file,
+// or a GPG key in the keyring of the given GnuPG home directory.
+func gitVerifyCommit(dir, sha, allowedSigners, gpgHome string) error {
+	args := []string{"verify-commit", sha}
+	if allowedSigners != "" {
+		abs, err := filepath.Abs(allowedSigners)
+		if err != nil {
+			return err
+		}
+		args = append([]string{"-c", "gpg.ssh.allowedSignersFile=" + abs}, args...)
+	}
+
+	cmd := exec.Command("git", args...)
 	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	if gpgHome != "" {
+		cmd.Env = append(cmd.Env, "GNUPGHOME="+gpgHome)
+	}
 	if out, err := cmd.CombinedOutput(); err != nil {
-		return "", fmt.Errorf("git error: %s", out)
+		return fmt.Errorf("commit %s is not signed by an allowed signer: %s", sha, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// gitClone clones the repo into dir unless it's already a git repo.
+func gitClone(url, dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return nil
+	}
+
+	start := time.Now()
+	if _, err := runGit(".", "clone", "--quiet", "--no-checkout", url, dir); err != nil {
+		return err
 	}
-	log.Printf("pulled git repo in %s", time.Since(start))
+	log.Printf("cloned git repo %s in %s", url, time.Since(start))
+	return nil
+}
 
-	cmd = exec.Command("git", "rev-parse", "--verify", "HEAD")
+func runGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
 	cmd.Dir = dir
 	out, err := cmd.CombinedOutput()
+	if err != nil && len(out) == 0 {
+		return "", fmt.Errorf("git error: %w", err)
+	}
 	if err != nil {
 		return "", fmt.Errorf("git error: %s", out)
 	}
-	rev := strings.TrimSpace(string(out))
-
-	return rev, nil
+	return strings.TrimSpace(string(out)), nil
 }
 
 func readInventory(dir string, inv *indexedInventory, nms *nodeMetadataStore) error {
-	cluster := &clusterSpec{}
-	_, err := toml.DecodeFile(filepath.Join(dir, "cluster.toml"), cluster)
+	cluster, err := inventory.ReadCluster(dir)
 	if os.IsNotExist(err) {
 		return nil // no inventory
 	}
@@ -72,32 +161,27 @@ func readInventory(dir string, inv *indexedInventory, nms *nodeMetadataStore) er
 		return err
 	}
 
-	containerIndex := map[string]*api.ContainerSpec{}
-	for _, node := range cluster.Nodes {
-		if node.Fingerprint == "" {
-			continue
+	for _, node := range inventory.BuildNodes(dir, cluster, inv.GitSHA) {
+		for _, fingerprint := range node.Spec.AllFingerprints() {
+			inv.NodesByFingerprint[fingerprint] = node.Inventory
 		}
-
-		nodeInv := &api.NodeInventory{GitSHA: inv.GitSHA}
-		for _, path := range node.Containers {
-			if container, ok := containerIndex[path]; ok {
-				nodeInv.Containers = append(nodeInv.Containers, container)
-				continue
-			}
-
-			container, err := readContainerSpec(filepath.Join(dir, path))
-			if err != nil {
-				log.Printf("error while reading container file %q referenced by node %q: %s", path, node.Fingerprint, err)
-				continue
-			}
-			containerIndex[path] = container
-			nodeInv.Containers = append(nodeInv.Containers, container)
+		if node.Spec.Name != "" {
+			inv.NodesByName[node.Spec.Name] = node.Inventory
 		}
-
-		inv.NodesByFingerprint[node.Fingerprint] = nodeInv
+		inv.NodesByID[node.Spec.ID()] = node.Inventory
 	}
 	for _, cli := range cluster.Clients {
-		inv.ClientsByFingerprint[cli.Fingerprint] = struct{}{}
+		grant, err := newClientGrant(cli, cluster)
+		if err != nil {
+			log.Printf("error while reading client %q: %s", cli.ID(), err)
+			continue
+		}
+		for _, fingerprint := range cli.AllFingerprints() {
+			inv.ClientsByFingerprint[fingerprint] = grant
+		}
+		if cli.Name != "" {
+			inv.ClientsByName[cli.Name] = grant
+		}
 	}
 
 	// Prune metadata for nodes that no longer exist
@@ -105,7 +189,7 @@ func readInventory(dir string, inv *indexedInventory, nms *nodeMetadataStore) er
 	defer nms.lock.Unlock()
 
 	for key := range nms.byFingerprint {
-		if _, ok := inv.NodesByFingerprint[key]; ok {
+		if inv.Node(key, key) != nil {
 			continue
 		}
 		delete(nms.byFingerprint, key)
@@ -114,52 +198,53 @@ func readInventory(dir string, inv *indexedInventory, nms *nodeMetadataStore) er
 	return nil
 }
 
-func readContainerSpec(file string) (*api.ContainerSpec, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, fmt.Errorf("opening file: %w", err)
-	}
-	defer f.Close()
-
-	hash := md5.New()
-	r := io.TeeReader(f, hash)
-
-	spec := &api.ContainerSpec{}
-	if _, err := toml.NewDecoder(r).Decode(spec); err != nil {
-		return nil, err
-	}
-
-	fileName := path.Base(file)
-	spec.Name = fileName[:len(fileName)-len(path.Ext(fileName))]
-	spec.Hash = hex.EncodeToString(hash.Sum(nil))
-
-	return spec, nil
-}
-
-type clusterSpec struct {
-	Nodes   []*nodeSpec   `toml:"node"`
-	Clients []*clientSpec `toml:"client"`
+type indexedInventory struct {
+	GitSHA               string
+	NodesByFingerprint   map[string]*api.NodeInventory
+	NodesByName          map[string]*api.NodeInventory
+	NodesByID            map[string]*api.NodeInventory // keyed by name, or primary fingerprint of unnamed nodes
+	Digests              string                        // version of the tracked image digests pinned in the containers
+	ClientsByFingerprint map[string]*clientGrant
+	ClientsByName        map[string]*clientGrant
 }
 
-type nodeSpec struct {
-	Fingerprint string   `toml:"fingerprint"`
-	Containers  []string `toml:"containers"`
+// Node returns the inventory of the node with the given cert fingerprint or CA-verified name.
+func (i *indexedInventory) Node(fingerprint, name string) *api.NodeInventory {
+	if i == nil {
+		return nil
+	}
+	if node := i.NodesByFingerprint[fingerprint]; node != nil {
+		return node
+	}
+	if name == "" {
+		return nil
+	}
+	return i.NodesByName[name]
 }
 
-type clientSpec struct {
-	Fingerprint string `toml:"fingerprint"`
-}
+// SiblingFingerprints returns the other fingerprints that belong to the same node as the given fingerprint.
+func (i *indexedInventory) SiblingFingerprints(fingerprint string) []string {
+	node := i.NodesByFingerprint[fingerprint]
+	if node == nil {
+		return nil
+	}
 
-type indexedInventory struct {
-	GitSHA               string
-	NodesByFingerprint   map[string]*api.NodeInventory
-	ClientsByFingerprint map[string]struct{}
+	siblings := []string{}
+	for key, val := range i.NodesByFingerprint {
+		if val == node && key != fingerprint {
+			siblings = append(siblings, key)
+		}
+	}
+	return siblings
 }
 
 func newIndexedInventory(gitSHA string) *indexedInventory {
 	return &indexedInventory{
 		GitSHA:               gitSHA,
 		NodesByFingerprint:   make(map[string]*api.NodeInventory),
-		ClientsByFingerprint: make(map[string]struct{}),
+		NodesByName:          make(map[string]*api.NodeInventory),
+		NodesByID:            make(map[string]*api.NodeInventory),
+		ClientsByFingerprint: make(map[string]*clientGrant),
+		ClientsByName:        make(map[string]*clientGrant),
 	}
 }
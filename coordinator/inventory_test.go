@@ -17,6 +17,8 @@ func TestReadInventory(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.Len(t, inv.NodesByFingerprint["test-fingerprint"].Containers, 2)
+	assert.Same(t, inv.NodesByFingerprint["test-fingerprint"], inv.NodesByFingerprint["test-fingerprint-next"])
+	assert.Equal(t, []string{"test-fingerprint-next"}, inv.SiblingFingerprints("test-fingerprint"))
 	assert.Nil(t, store.Get("not-a-node"))
 	assert.NotNil(t, store.Get("test-fingerprint"))
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/rpc"
+)
+
+// loginIssuer is the coordinator's internal CA, which issues short-lived client certs to `rectl login`.
+type loginIssuer struct {
+	Cert        *x509.Certificate
+	Key         crypto.Signer
+	Token       []byte        // optional bootstrap token that allows untrusted clients to log in
+	TokenRole   role          // highest role available to clients that log in using the token
+	MaxDuration time.Duration // upper bound on the validity of issued certs
+}
+
+// Authorizer trusts any unexpired cert issued by the internal CA.
+func (l *loginIssuer) Authorizer() *rpc.CAAuthorizer {
+	pool := x509.NewCertPool()
+	pool.AddCert(l.Cert)
+	return &rpc.CAAuthorizer{Roots: pool}
+}
+
+// newLoginHandler signs the PEM-encoded public key in the request body.
+// Callers must either be trusted clients or present the bootstrap token.
+// Issued certs can't carry a role higher than the caller's.
+func newLoginHandler(issuer *loginIssuer, policy *clientPolicy) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		q := r.URL.Query()
+
+		name, trusted := rpc.Authorize(policy, r.TLS.PeerCertificates)
+		if trusted && name == "" {
+			name = q.Get("fingerprint")
+		}
+
+		maxRole := issuer.TokenRole
+		if trusted {
+			grant := policy.Grant(r.TLS.PeerCertificates)
+			if grant.Scoped() {
+				http.Error(w, "clients with a container or node scope can't log in", 403)
+				return
+			}
+			maxRole = grant.Role
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !trusted && (len(issuer.Token) == 0 || !hmac.Equal([]byte(token), issuer.Token)) {
+			w.WriteHeader(403)
+			return
+		}
+		if !trusted {
+			name = q.Get("user") // bootstrapped clients don't have an identity yet
+		}
+		if name == "" {
+			http.Error(w, "a name is required", 400)
+			return
+		}
+
+		duration := issuer.MaxDuration
+		if d := q.Get("duration"); d != "" {
+			var err error
+			duration, err = time.ParseDuration(d)
+			if err != nil || duration <= 0 || duration > issuer.MaxDuration {
+				http.Error(w, fmt.Sprintf("duration must be between 0 and %s", issuer.MaxDuration), 400)
+				return
+			}
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		block, _ := pem.Decode(body)
+		if block == nil {
+			http.Error(w, "a PEM-encoded public key is required", 400)
+			return
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			http.Error(w, "invalid public key", 400)
+			return
+		}
+
+		certRole := maxRole
+		if rs := q.Get("role"); rs != "" {
+			var err error
+			certRole, err = parseRole(rs)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		if certRole > maxRole {
+			http.Error(w, fmt.Sprintf("the role can't exceed %s", maxRole), 403)
+			return
+		}
+		subject := pkix.Name{CommonName: name, OrganizationalUnit: []string{certRole.String()}}
+
+		cert, err := rpc.IssueCertificate(issuer.Cert, issuer.Key, pub, subject, duration)
+		if err != nil {
+			log.Printf("error while issuing client cert: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+
+		log.Printf("issued client cert for %q (role=%s) valid for %s", name, certRole, duration)
+		w.Write(cert)
+	}
+}
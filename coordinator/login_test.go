@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/concurrency"
+	"github.com/jveski/recompose/internal/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogin(t *testing.T) {
+	caCert, caKey, err := rpc.GenCA(t.TempDir())
+	require.NoError(t, err)
+	issuer := &loginIssuer{Cert: caCert, Key: caKey, Token: []byte("test-token"), TokenRole: roleViewer, MaxDuration: time.Hour}
+
+	clientCert, clientFingerprint, err := rpc.GenCertificate(t.TempDir())
+	require.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(clientCert.Leaf.PublicKey)
+	require.NoError(t, err)
+	pubPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+
+	state := &concurrency.StateContainer[*indexedInventory]{}
+	state.Swap(newIndexedInventory(""))
+	fn := newLoginHandler(issuer, &clientPolicy{Container: state})
+
+	login := func(query, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "https://test/?"+query, bytes.NewReader(pubPem))
+		r.TLS.PeerCertificates = []*x509.Certificate{clientCert.Leaf}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		rpc.WithAuth(rpc.AuthorizerFunc(func(string) bool { return true }), fn)(w, r, httprouter.Params{})
+		return w
+	}
+
+	t.Run("untrusted", func(t *testing.T) {
+		assert.Equal(t, 403, login("user=alice", "").Code)
+		assert.Equal(t, 403, login("user=alice", "wrong-token").Code)
+	})
+
+	t.Run("bootstrap token", func(t *testing.T) {
+		w := login("user=alice&role=viewer&duration=30m", "test-token")
+		require.Equal(t, 200, w.Code)
+
+		block, _ := pem.Decode(w.Body.Bytes())
+		require.NotNil(t, block)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", cert.Subject.CommonName)
+		assert.Equal(t, []string{"viewer"}, cert.Subject.OrganizationalUnit)
+		assert.WithinDuration(t, time.Now().Add(time.Minute*30), cert.NotAfter, time.Minute)
+
+		name, ok := issuer.Authorizer().TrustsCertificate([]*x509.Certificate{cert})
+		assert.True(t, ok)
+		assert.Equal(t, "alice", name)
+	})
+
+	t.Run("bootstrap token role is capped", func(t *testing.T) {
+		assert.Equal(t, 403, login("user=alice&role=operator", "test-token").Code)
+	})
+
+	t.Run("trusted client", func(t *testing.T) {
+		inv := newIndexedInventory("")
+		inv.ClientsByFingerprint[clientFingerprint] = &clientGrant{Role: roleOperator}
+		state.Swap(inv)
+
+		w := login("", "")
+		require.Equal(t, 200, w.Code)
+
+		block, _ := pem.Decode(w.Body.Bytes())
+		require.NotNil(t, block)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"operator"}, cert.Subject.OrganizationalUnit)
+
+		assert.Equal(t, 403, login("role=admin", "").Code)
+		assert.Equal(t, 400, login("role=superuser", "").Code)
+	})
+
+	t.Run("scoped client", func(t *testing.T) {
+		inv := newIndexedInventory("")
+		inv.ClientsByFingerprint[clientFingerprint] = &clientGrant{Role: roleOperator, Containers: map[string]struct{}{"nginx": {}}}
+		state.Swap(inv)
+
+		assert.Equal(t, 403, login("", "").Code)
+	})
+
+	t.Run("duration too long", func(t *testing.T) {
+		inv := newIndexedInventory("")
+		inv.ClientsByFingerprint[clientFingerprint] = &clientGrant{Role: roleOperator}
+		state.Swap(inv)
+
+		assert.Equal(t, 400, login("duration=2h", "").Code)
+	})
+}
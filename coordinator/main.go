@@ -1,37 +1,84 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/jveski/recompose/internal/api"
 	"github.com/jveski/recompose/internal/concurrency"
 	"github.com/jveski/recompose/internal/rpc"
 )
 
 func main() {
 	var (
-		privateAddr        = flag.String("private-addr", ":8123", "address on which to serve the private API (accessed by agents)")
-		publicAddr         = flag.String("public-addr", "", "(optional) address on which to serve the public API (i.e. webhooks)")
-		gitPollingInterval = flag.Duration("git-polling-interval", time.Minute*5, "how often to `git pull`")
-		agentTimeout       = flag.Duration("agent-timeout", time.Second*15, "timeout for requests to agents")
-		webhookKey         = []byte(os.Getenv("WEBHOOK_HMAC_KEY"))
+		privateAddr         = flag.String("private-addr", ":8123", "address on which to serve the private API (accessed by agents)")
+		publicAddr          = flag.String("public-addr", "", "(optional) address on which to serve the public API (i.e. webhooks)")
+		gitPollingInterval  = flag.Duration("git-polling-interval", time.Minute*5, "how often to `git fetch` (or re-read the inventory directory)")
+		inventorySourceKind = flag.String("inventory-source", "git", "where the inventory comes from: git (pull ./repo), dir (read --inventory-dir), or push (tarballs uploaded by `rectl push`)")
+		gitURL              = flag.String("git-url", "", "(optional) URL of the GitOps repo, cloned into ./repo on first start. Otherwise ./repo must be cloned by hand")
+		gitRef              = flag.String("git-ref", "", "(optional) branch or tag to deploy (defaults to the upstream of the branch checked out in ./repo)")
+		gitSubdir           = flag.String("git-subdir", "", "(optional) directory of the repo holding cluster.toml i.e. when one repo serves several clusters")
+		gitAllowedSigners   = flag.String("git-allowed-signers", "", "(optional) only deploy commits signed by an SSH key listed in this allowed signers file (keep it outside of the repo)")
+		gitGPGHome          = flag.String("git-gpg-home", "", "(optional) only deploy commits signed by a GPG key in the keyring of this GnuPG home directory")
+		inventoryDir        = flag.String("inventory-dir", "", "directory holding cluster.toml when --inventory-source=dir")
+		pushAllowedSigners  = flag.String("push-allowed-signers", "", "ssh allowed signers file listing the keys that may sign tarballs when --inventory-source=push")
+		imageTrackInterval  = flag.Duration("image-tracking-interval", time.Minute*5, "how often to resolve the tags of images used by containers with image_policy = \"track\"")
+		imageArchiveDir     = flag.String("image-archive-dir", "images", "directory of image archives (<digest>.tar) served to agents started with --pull-from-coordinator. Missing archives are pulled for the agent's platform using podman")
+		agentTimeout        = flag.Duration("agent-timeout", time.Second*15, "timeout for requests to agents")
+		ageIdentity         = flag.String("age-identity", "identity.txt", "path to the age identity used to decrypt secrets")
+		secretsDir          = flag.String("secrets-dir", "", "(optional) directory of plaintext secret files served by the `file` secret provider - intended for dev clusters")
+		secretHelper        = flag.String("secret-helper", "", "(optional) command that decrypts ciphertext from stdin, used by the `exec` secret provider")
+		caCert              = flag.String("ca-cert", "", "(optional) PEM bundle of CAs that issue agent and client certs. Nodes and clients are then matched by the `name` in cluster.toml")
+		caCRL               = flag.String("ca-crl", "", "(optional) certificate revocation list of the CA given by --ca-cert")
+		tlsCert             = flag.String("tls-cert", "", "(optional) serve using this cert i.e. one issued by a CA, rather than a generated self-signed cert")
+		tlsKey              = flag.String("tls-key", "", "private key of --tls-cert")
+		rotateCert          = flag.Bool("rotate-cert", false, "generate the next cert and exit. The running coordinator switches to it once every node in the inventory has registered and trusts its fingerprint")
+		maxLoginDuration    = flag.Duration("max-login-duration", time.Hour*12, "maximum validity of client certs issued by `rectl login`")
+		loginTokenRole      = flag.String("login-token-role", "viewer", "highest role available to clients that log in using LOGIN_TOKEN")
+		webhookKey          = []byte(os.Getenv("WEBHOOK_HMAC_KEY"))
+		loginToken          = []byte(os.Getenv("LOGIN_TOKEN"))
+		joinToken           = []byte(os.Getenv("JOIN_TOKEN"))
 	)
 	flag.Parse()
 
+	if *rotateCert {
+		_, fingerprint, err := rpc.GenNextCertificate(".")
+		if err != nil {
+			log.Fatalf("fatal error while generating next certificate: %s", err)
+		}
+		fmt.Printf("Generated the next certificate. Add its fingerprint to every agent's --coordinator-fingerprint to complete the rotation:\n\n%s\n", fingerprint)
+		return
+	}
+
 	var (
-		webhookSignal = make(chan struct{}, 1)
+		webhookSignal = newSyncQueue()
 		state         = &concurrency.StateContainer[*indexedInventory]{}
+		syncStatus    = &concurrency.StateContainer[*api.SyncStatus]{}
 		nodeStore     = newNodeMetadataStore()
-		repoDir       = "./repo"
 		agentClient   *rpc.Client
 	)
 
-	if err := os.MkdirAll(repoDir, 0755); err != nil {
-		log.Fatalf("fatal error while creating git repo directory: %s", err)
+	source, err := newInventorySource(*inventorySourceKind, *inventoryDir, *pushAllowedSigners,
+		&gitSource{Path: "./repo", PinFile: "pin.txt", URL: *gitURL, Ref: *gitRef, Subdir: *gitSubdir, AllowedSigners: *gitAllowedSigners, GPGHome: *gitGPGHome})
+	if err != nil {
+		log.Fatalf("invalid --inventory-source: %s", err)
+	}
+	secrets := map[string]secretBackend{
+		"age":  &ageBackend{IdentityFile: *ageIdentity},
+		"sops": &sopsBackend{Dir: source.Dir()},
+	}
+	if *secretsDir != "" {
+		secrets["file"] = &fileBackend{Dir: *secretsDir}
+	}
+	if *secretHelper != "" {
+		secrets["exec"] = &execBackend{Command: strings.Fields(*secretHelper)}
 	}
 
 	// The public server exposes Git webhook endpoints - only served when configured
@@ -44,34 +91,149 @@ func main() {
 		}()
 	}
 
-	cert, _, err := rpc.GenCertificate(".")
+	cert, err := loadCertificate(*tlsCert, *tlsKey)
 	if err != nil {
 		log.Fatalf("fatal error while generating certificate: %s", err)
 	}
 
-	// Client used to access agents should only trust known agents as per the inventory
-	agentClient = rpc.NewClient(cert, time.Minute*5, &agentAuthorizer{Container: state})
+	var ca *rpc.CAAuthorizer
+	if *caCert != "" {
+		ca, err = rpc.LoadCAAuthorizer(*caCert, *caCRL)
+		if err != nil {
+			log.Fatalf("fatal error while loading CA: %s", err)
+		}
+	}
+
+	// The internal CA issues short-lived client certs to `rectl login`
+	loginCA, loginKey, err := rpc.GenCA(".")
+	if err != nil {
+		log.Fatalf("fatal error while generating internal CA: %s", err)
+	}
+	tokenRole, err := parseRole(*loginTokenRole)
+	if err != nil {
+		log.Fatalf("invalid --login-token-role: %s", err)
+	}
+	issuer := &loginIssuer{Cert: loginCA, Key: loginKey, Token: loginToken, TokenRole: tokenRole, MaxDuration: *maxLoginDuration}
+
+	// Client used to access agents should only trust known agents as per the inventory.
+	// Agents are reached over the tunnels they open to the coordinator when possible.
+	agentClient = rpc.NewClient(cert, time.Minute*5, &agentAuthorizer{Container: state, CA: ca})
+	tunnels := rpc.NewTunnelPool()
+	agentTransport := agentClient.Transport.(*http.Transport)
+	agentTransport.DialTLSContext = (&agentDialer{Container: state, Store: nodeStore, Tunnels: tunnels, TLS: agentTransport.TLSClientConfig}).DialTLSContext
 
-	// Block initialization until the inventory has been sync'd to avoid serving empty an empty inventory.
-	err = syncInventory(repoDir, state, nodeStore)
+	// Try to sync the inventory before serving to avoid rejecting agents and clients unnecessarily.
+	// Nothing is trusted until the first successful sync, so the coordinator never serves an empty inventory
+	// while e.g. the git remote is unreachable or HEAD isn't signed - the sync loop keeps retrying.
+	history := &deploymentHistory{File: "history.toml"}
+	tracker := &digestTracker{Resolver: &registryResolver{Client: http.DefaultClient, Secrets: secrets}, Timeout: time.Second * 30, File: "digests.toml"}
+	err = syncInventory(source, state, nodeStore, history, tracker, "startup")
 	if err != nil {
-		log.Fatalf("error syncing inventory: %s", err)
+		log.Printf("error syncing inventory (will retry): %s", err)
+		webhookSignal.Trigger("startup")
 	}
+	recordSync(syncStatus, err)
 
 	// Update inventory async to the HTTP request handlers
-	go concurrency.RunLoop(webhookSignal, *gitPollingInterval, time.Minute*30, func() bool {
-		err := syncInventory(repoDir, state, nodeStore)
+	go concurrency.RunLoop(webhookSignal.C, *gitPollingInterval, time.Minute*30, func() bool {
+		err := syncInventory(source, state, nodeStore, history, tracker, webhookSignal.Take())
 		if err != nil {
 			log.Printf("error syncing inventory: %s", err)
 		}
+		recordSync(syncStatus, err)
+		return err == nil
+	})
+
+	// Tracked images are redeployed when their tag is pushed to
+	go concurrency.RunLoop(make(chan struct{}), *imageTrackInterval, time.Minute*30, func() bool {
+		changed, err := tracker.Refresh()
+		if err != nil {
+			log.Printf("error while resolving image digests: %s", err)
+		}
+		if changed {
+			webhookSignal.Trigger("digest")
+		}
+		return err == nil
+	})
+
+	// Cert rotations started by --rotate-cert are completed once every node in the inventory trusts the next cert
+	go concurrency.RunLoop(make(chan struct{}), time.Minute, time.Minute, func() bool {
+		err := completeCertRotation(state, nodeStore)
+		if err != nil {
+			log.Printf("error while rotating certificate: %s", err)
+		}
 		return err == nil
 	})
 
 	// This is the main HTTP server that accepts requests to the internal coordination API
 	svr := rpc.NewServer(*privateAddr, cert,
-		rpc.WithLogging(newApiHandler(state, nodeStore, agentClient, *agentTimeout)))
+		rpc.WithLogging(newApiHandler(state, nodeStore, agentClient, *agentTimeout, secrets, ca, issuer, newPendingNodeStore(), joinToken, tunnels, source, webhookSignal, syncStatus, history, &imageArchiveStore{Dir: *imageArchiveDir, Secrets: secrets})))
 
 	if err := svr.ListenAndServeTLS("", ""); err != nil {
 		log.Fatalf("fatal error while running private API HTTP server: %s", err)
 	}
 }
+
+func loadCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile != "" {
+		cert, _, err := rpc.LoadCertificate(certFile, keyFile)
+		return cert, err
+	}
+	cert, _, err := rpc.GenCertificate(".")
+	return cert, err
+}
+
+// completeCertRotation switches to the cert generated by --rotate-cert once every node in the inventory trusts it.
+// The process exits after switching so it can be restarted by its supervisor using the new cert.
+func completeCertRotation(state inventoryContainer, nodeStore *nodeMetadataStore) error {
+	if !rpc.HasNextCertificate(".") {
+		return nil
+	}
+
+	_, fingerprint, err := rpc.GenNextCertificate(".")
+	if err != nil {
+		return fmt.Errorf("loading next certificate: %w", err)
+	}
+
+	if waiting := findUntrustingNode(state.Get(), nodeStore, fingerprint); waiting != "" {
+		log.Printf("waiting for %s to trust the next certificate: %s", waiting, fingerprint)
+		return nil
+	}
+
+	if err := rpc.PromoteNextCertificate("."); err != nil {
+		return fmt.Errorf("promoting next certificate: %w", err)
+	}
+	log.Printf("switched to the next certificate - exiting to restart using it")
+	os.Exit(0)
+	return nil
+}
+
+// findUntrustingNode describes a node in the inventory that hasn't registered, or doesn't trust the given fingerprint yet.
+// Returns an empty string once every node trusts it. Offline nodes block the rotation since they'd be locked out.
+func findUntrustingNode(inv *indexedInventory, store *nodeMetadataStore, fingerprint string) string {
+	if inv == nil || len(inv.NodesByID) == 0 {
+		return "the inventory" // nodes can't have registered yet
+	}
+
+	for id, node := range inv.NodesByID {
+		var meta *nodeMetadata
+		for key, val := range inv.NodesByFingerprint {
+			if val == node && store.Get(key) != nil {
+				meta = store.Get(key)
+			}
+		}
+		for key, val := range inv.NodesByName {
+			if val == node && store.Get(key) != nil {
+				meta = store.Get(key)
+			}
+		}
+
+		if meta == nil {
+			return fmt.Sprintf("node %s (not registered)", id)
+		}
+		if !meta.TrustsAll(fingerprint) {
+			return fmt.Sprintf("node %s", id)
+		}
+	}
+	return ""
+}
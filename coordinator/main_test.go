@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jveski/recompose/internal/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindUntrustingNode(t *testing.T) {
+	store := newNodeMetadataStore()
+
+	// Nothing is promoted before the inventory has been read
+	assert.Equal(t, "the inventory", findUntrustingNode(nil, store, "next"))
+	assert.Equal(t, "the inventory", findUntrustingNode(newIndexedInventory(""), store, "next"))
+
+	inv := newIndexedInventory("")
+	node1, node2 := &api.NodeInventory{}, &api.NodeInventory{}
+	inv.NodesByFingerprint["fp-1"] = node1
+	inv.NodesByFingerprint["fp-1-next"] = node1
+	inv.NodesByID["fp-1"] = node1
+	inv.NodesByName["node-2"] = node2
+	inv.NodesByID["node-2"] = node2
+
+	// Nodes that haven't registered i.e. right after a restart block the rotation
+	store.Set("fp-1-next", &nodeMetadata{Fingerprint: "fp-1-next", Trusts: []string{"current", "next"}})
+	assert.Equal(t, "node node-2 (not registered)", findUntrustingNode(inv, store, "next"))
+
+	store.Set("node-2", &nodeMetadata{Fingerprint: "node-2", Trusts: []string{"current"}})
+	assert.Equal(t, "node node-2", findUntrustingNode(inv, store, "next"))
+
+	store.Set("node-2", &nodeMetadata{Fingerprint: "node-2", Trusts: []string{"current", "next"}})
+	assert.Empty(t, findUntrustingNode(inv, store, "next"))
+}
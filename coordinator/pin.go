@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var shaPattern = regexp.MustCompile(`^[0-9a-f]{4,64}$`)
+
+// Pinned returns the commit set by `rectl pin`, or an empty string when the latest commit of the ref is deployed.
+func (g *gitSource) Pinned() string {
+	g.pinLock.Lock()
+	defer g.pinLock.Unlock()
+	return g.pin
+}
+
+// Pin deploys the given commit (or unique prefix) regardless of the ref until Unpin is called.
+// Returns the full SHA of the commit.
+func (g *gitSource) Pin(sha string) (string, error) {
+	if !shaPattern.MatchString(sha) {
+		return "", fmt.Errorf("invalid commit SHA %q", sha)
+	}
+	full, err := runGit(g.Path, "rev-parse", "--verify", "--quiet", sha+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("commit %s not found", sha)
+	}
+	return full, g.setPin(full)
+}
+
+// Rollback pins the parent of the given commit.
+func (g *gitSource) Rollback(current string) (string, error) {
+	if !shaPattern.MatchString(current) {
+		return "", errors.New("the current inventory wasn't read from a git commit")
+	}
+	parent, err := runGit(g.Path, "rev-parse", "--verify", "--quiet", current+"^")
+	if err != nil {
+		return "", fmt.Errorf("commit %s has no parent", current)
+	}
+	return parent, g.setPin(parent)
+}
+
+// resolvePin returns the full SHA of the pinned commit, or an empty string when nothing is pinned.
+// The remote is only fetched when the commit isn't already in the local repo.
+func (g *gitSource) resolvePin() (string, error) {
+	pin := g.Pinned()
+	if pin == "" {
+		return "", nil
+	}
+	if !shaPattern.MatchString(pin) {
+		return "", fmt.Errorf("invalid pinned commit SHA %q", pin)
+	}
+	if sha, err := runGit(g.Path, "rev-parse", "--verify", "--quiet", pin+"^{commit}"); err == nil {
+		return sha, nil
+	}
+	if _, err := gitFetch(g.Path, g.Ref); err != nil {
+		return "", fmt.Errorf("fetching pinned commit %s: %w", pin, err)
+	}
+	sha, err := runGit(g.Path, "rev-parse", "--verify", "--quiet", pin+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("pinned commit %s not found", pin)
+	}
+	return sha, nil
+}
+
+func (g *gitSource) Unpin() error { return g.setPin("") }
+
+func (g *gitSource) setPin(sha string) error {
+	g.pinLock.Lock()
+	defer g.pinLock.Unlock()
+
+	if g.PinFile != "" {
+		if err := os.WriteFile(g.PinFile, []byte(sha), 0644); err != nil {
+			return fmt.Errorf("writing pin file: %w", err)
+		}
+	}
+	g.pin = sha
+	return nil
+}
+
+func (g *gitSource) loadPin() error {
+	if g.PinFile == "" {
+		return nil
+	}
+
+	buf, err := os.ReadFile(g.PinFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading pin file: %w", err)
+	}
+
+	g.pin = strings.TrimSpace(string(buf))
+	if g.pin != "" {
+		log.Printf("deploying commit %s until it's unpinned", g.pin)
+	}
+	return nil
+}
+
+// newPinHandler pins the commit given by the `sha` query param, or when `rollback` is set, the parent of the commit currently being served.
+// Responds with the full SHA of the pinned commit.
+func newPinHandler(state inventoryContainer, source *gitSource, signal *syncQueue) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		q := r.URL.Query()
+
+		var sha string
+		var err error
+		trigger := "pin"
+		if q.Has("rollback") {
+			trigger = "rollback"
+		}
+		if q.Has("rollback") && q.Get("sha") == "" {
+			var current string
+			if inv := state.Get(); inv != nil {
+				current = inv.GitSHA
+			}
+			sha, err = source.Rollback(current)
+		} else {
+			sha, err = source.Pin(q.Get("sha"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		log.Printf("pinned commit %s", sha)
+
+		signal.Trigger(trigger)
+		w.Write([]byte(sha))
+	}
+}
+
+func newUnpinHandler(source *gitSource, signal *syncQueue) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if err := source.Unpin(); err != nil {
+			log.Printf("error while unpinning commit: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		log.Printf("unpinned commit")
+
+		signal.Trigger("unpin")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/concurrency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitSourcePin(t *testing.T) {
+	dir := t.TempDir()
+	upstream := filepath.Join(dir, "upstream")
+	commit := func(content string) string {
+		t.Helper()
+		require.NoError(t, os.WriteFile(filepath.Join(upstream, "cluster.toml"), []byte(content), 0644))
+		for _, args := range [][]string{{"add", "-A"}, {"-c", "user.name=test", "-c", "user.email=test@test", "commit", "-q", "-m", content}} {
+			_, err := runGit(upstream, args...)
+			require.NoError(t, err)
+		}
+		sha, err := runGit(upstream, "rev-parse", "HEAD")
+		require.NoError(t, err)
+		return sha
+	}
+
+	require.NoError(t, os.MkdirAll(upstream, 0755))
+	_, err := runGit(upstream, "init", "-q", "-b", "main")
+	require.NoError(t, err)
+	first := commit("# first")
+	second := commit("# second")
+
+	pinFile := filepath.Join(dir, "pin.txt")
+	source := &gitSource{Path: filepath.Join(dir, "repo"), URL: upstream, Ref: "main", PinFile: pinFile}
+	sha, err := source.Sync()
+	require.NoError(t, err)
+	assert.Equal(t, second, sha)
+
+	sha, err = source.Rollback(sha)
+	require.NoError(t, err)
+	assert.Equal(t, first, sha)
+
+	// New commits aren't deployed while pinned
+	commit("# third")
+	sha, err = source.Sync()
+	require.NoError(t, err)
+	assert.Equal(t, first, sha)
+
+	content, err := os.ReadFile(filepath.Join(source.Dir(), "cluster.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, "# first", string(content))
+
+	// Pinned commits are still deployed while the remote is unreachable
+	require.NoError(t, os.Rename(upstream, upstream+"-moved"))
+	sha, err = source.Sync()
+	require.NoError(t, err)
+	assert.Equal(t, first, sha)
+	require.NoError(t, os.Rename(upstream+"-moved", upstream))
+
+	// The pin survives restarts
+	restarted := &gitSource{Path: source.Path, Ref: "main", PinFile: pinFile}
+	require.NoError(t, restarted.loadPin())
+	assert.Equal(t, first, restarted.Pinned())
+
+	sha, err = restarted.Pin(second[:7])
+	require.NoError(t, err)
+	assert.Equal(t, second, sha)
+
+	require.NoError(t, restarted.Unpin())
+	sha, err = restarted.Sync()
+	require.NoError(t, err)
+	assert.NotEqual(t, second, sha)
+	assert.Empty(t, restarted.Pinned())
+
+	_, err = restarted.Pin("--help")
+	assert.EqualError(t, err, `invalid commit SHA "--help"`)
+
+	_, err = restarted.Pin("0000000")
+	assert.EqualError(t, err, "commit 0000000 not found")
+
+	_, err = restarted.Rollback(first)
+	assert.EqualError(t, err, "commit "+first+" has no parent")
+}
+
+func TestPinHandler(t *testing.T) {
+	state := &concurrency.StateContainer[*indexedInventory]{}
+	state.Swap(newIndexedInventory("not-a-sha"))
+	fn := newPinHandler(state, &gitSource{Path: t.TempDir()}, newSyncQueue())
+
+	w := httptest.NewRecorder()
+	fn(w, httptest.NewRequest("POST", "/?rollback=true", nil), httprouter.Params{})
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, "the current inventory wasn't read from a git commit\n", w.Body.String())
+}
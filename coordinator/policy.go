@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/inventory"
+	"github.com/jveski/recompose/internal/rpc"
+)
+
+// role determines which API routes a client can access. Each role includes the permissions of the previous.
+type role int
+
+const (
+	roleViewer   role = iota + 1 // cluster status
+	roleOperator                 // container logs
+	roleAdmin                    // mutating operations
+)
+
+func parseRole(s string) (role, error) {
+	switch s {
+	case "viewer":
+		return roleViewer, nil
+	case "operator":
+		return roleOperator, nil
+	case "admin":
+		return roleAdmin, nil
+	default:
+		return 0, fmt.Errorf("unknown role %q", s)
+	}
+}
+
+func (r role) String() string {
+	switch r {
+	case roleViewer:
+		return "viewer"
+	case roleOperator:
+		return "operator"
+	case roleAdmin:
+		return "admin"
+	default:
+		return "unknown"
+	}
+}
+
+// clientGrant describes what a client is allowed to access.
+type clientGrant struct {
+	Role role
+
+	// Optional scope. Nodes holds every fingerprint and name of the nodes in scope.
+	Containers map[string]struct{}
+	Nodes      map[string]struct{}
+}
+
+func (g *clientGrant) Scoped() bool { return len(g.Containers) > 0 || len(g.Nodes) > 0 }
+
+// Allows returns true when the given container on the given node is within the grant's scope.
+func (g *clientGrant) Allows(node, container string) bool {
+	if len(g.Nodes) > 0 {
+		if _, ok := g.Nodes[node]; !ok {
+			return false
+		}
+	}
+	if len(g.Containers) > 0 {
+		if _, ok := g.Containers[container]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// newClientGrant resolves the role and scope of a client declared in cluster.toml.
+func newClientGrant(c *inventory.ClientSpec, cluster *inventory.ClusterSpec) (*clientGrant, error) {
+	grant := &clientGrant{Role: roleOperator}
+	if c.Role != "" {
+		var err error
+		grant.Role, err = parseRole(c.Role)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range c.Containers {
+		if grant.Containers == nil {
+			grant.Containers = map[string]struct{}{}
+		}
+		grant.Containers[name] = struct{}{}
+	}
+
+	// Nodes are known to the agent metadata store by either name or fingerprint, so index every one of them
+	for _, id := range c.Nodes {
+		node := cluster.FindNode(id)
+		if node == nil {
+			return nil, fmt.Errorf("node %q is not declared in cluster.toml", id)
+		}
+		if grant.Nodes == nil {
+			grant.Nodes = map[string]struct{}{}
+		}
+		for _, fingerprint := range node.AllFingerprints() {
+			grant.Nodes[fingerprint] = struct{}{}
+		}
+		if node.Name != "" {
+			grant.Nodes[node.Name] = struct{}{}
+		}
+	}
+
+	return grant, nil
+}
+
+// clientPolicy resolves the grants of rectl clients.
+type clientPolicy struct {
+	Container inventoryContainer
+	CA        *rpc.CAAuthorizer // optional - matched against client names in cluster.toml
+	Logins    *rpc.CAAuthorizer // optional - trusts any cert issued by `rectl login`
+}
+
+// Grant returns the grant of the client presenting the given cert chain, or nil if it isn't trusted.
+func (p *clientPolicy) Grant(chain []*x509.Certificate) *clientGrant {
+	state := p.Container.Get()
+	if state == nil || len(chain) == 0 {
+		return nil
+	}
+	if grant := state.ClientsByFingerprint[rpc.GetCertFingerprint(chain[0].Raw)]; grant != nil {
+		return grant
+	}
+	grant, _ := p.verify(state, chain)
+	return grant
+}
+
+// verify resolves the grant and name of clients trusted by their CA-issued certificate.
+func (p *clientPolicy) verify(state *indexedInventory, chain []*x509.Certificate) (*clientGrant, string) {
+	if p.Logins != nil {
+		if name, err := p.Logins.Verify(chain); err == nil {
+			return getLoginGrant(chain[0]), name
+		}
+	}
+	if p.CA != nil {
+		if name, err := p.CA.Verify(chain); err == nil {
+			return state.ClientsByName[name], name
+		}
+	}
+	return nil, ""
+}
+
+func (p *clientPolicy) TrustsCert(fingerprint string) bool {
+	state := p.Container.Get()
+	return state != nil && state.ClientsByFingerprint[fingerprint] != nil
+}
+
+func (p *clientPolicy) TrustsCertificate(chain []*x509.Certificate) (string, bool) {
+	state := p.Container.Get()
+	if state == nil || len(chain) == 0 {
+		return "", false
+	}
+	grant, name := p.verify(state, chain)
+	return name, grant != nil
+}
+
+// getLoginGrant returns the grant of a cert issued by `rectl login`, which embeds the role in its subject.
+func getLoginGrant(cert *x509.Certificate) *clientGrant {
+	if len(cert.Subject.OrganizationalUnit) == 0 {
+		return &clientGrant{Role: roleViewer}
+	}
+	r, err := parseRole(cert.Subject.OrganizationalUnit[0])
+	if err != nil {
+		return nil
+	}
+	return &clientGrant{Role: r}
+}
+
+type grantKey struct{}
+
+// withPolicy only allows clients with at least the given role to access the route.
+func withPolicy(policy *clientPolicy, min role, next httprouter.Handle) httprouter.Handle {
+	return rpc.WithAuth(policy, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		grant := policy.Grant(r.TLS.PeerCertificates)
+		if grant == nil || grant.Role < min {
+			http.Error(w, fmt.Sprintf("this operation requires the %s role", min), 403)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), grantKey{}, grant)), p)
+	})
+}
+
+// requestGrant returns the grant of the client that sent the request.
+// Requests that didn't pass through withPolicy aren't scoped.
+func requestGrant(r *http.Request) *clientGrant {
+	grant, _ := r.Context().Value(grantKey{}).(*clientGrant)
+	if grant == nil {
+		return &clientGrant{}
+	}
+	return grant
+}
+
+// withContainerScope rejects requests for containers outside of the client's scope.
+func withContainerScope(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !requestGrant(r).Allows(p.ByName("fingerprint"), r.URL.Query().Get("container")) {
+			http.Error(w, "the container is not within the client's scope", 403)
+			return
+		}
+		next(w, r, p)
+	}
+}
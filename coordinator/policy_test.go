@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/concurrency"
+	"github.com/jveski/recompose/internal/inventory"
+	"github.com/jveski/recompose/internal/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientGrant(t *testing.T) {
+	cluster := &inventory.ClusterSpec{Nodes: []*inventory.NodeSpec{{Name: "node-1", Fingerprint: "fp-1", Fingerprints: []string{"fp-1-next"}}}}
+
+	t.Run("default role", func(t *testing.T) {
+		grant, err := newClientGrant(&inventory.ClientSpec{}, cluster)
+		require.NoError(t, err)
+		assert.Equal(t, roleOperator, grant.Role)
+		assert.False(t, grant.Scoped())
+		assert.True(t, grant.Allows("anything", "anything"))
+	})
+
+	t.Run("scoped", func(t *testing.T) {
+		grant, err := newClientGrant(&inventory.ClientSpec{Role: "viewer", Containers: []string{"nginx"}, Nodes: []string{"node-1"}}, cluster)
+		require.NoError(t, err)
+		assert.Equal(t, roleViewer, grant.Role)
+		assert.True(t, grant.Allows("fp-1", "nginx"))
+		assert.True(t, grant.Allows("fp-1-next", "nginx"))
+		assert.True(t, grant.Allows("node-1", "nginx"))
+		assert.False(t, grant.Allows("fp-1", "postgres"))
+		assert.False(t, grant.Allows("fp-2", "nginx"))
+	})
+
+	t.Run("invalid role", func(t *testing.T) {
+		_, err := newClientGrant(&inventory.ClientSpec{Role: "root"}, cluster)
+		assert.EqualError(t, err, `unknown role "root"`)
+	})
+
+	t.Run("unknown node", func(t *testing.T) {
+		_, err := newClientGrant(&inventory.ClientSpec{Nodes: []string{"nope"}}, cluster)
+		assert.EqualError(t, err, `node "nope" is not declared in cluster.toml`)
+	})
+}
+
+func TestWithPolicy(t *testing.T) {
+	cert, fingerprint, err := rpc.GenCertificate(t.TempDir())
+	require.NoError(t, err)
+
+	state := &concurrency.StateContainer[*indexedInventory]{}
+	policy := &clientPolicy{Container: state}
+
+	var called bool
+	fn := withPolicy(policy, roleOperator, withContainerScope(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) { called = true }))
+
+	call := func(grant *clientGrant, container string) int {
+		inv := newIndexedInventory("")
+		if grant != nil {
+			inv.ClientsByFingerprint[fingerprint] = grant
+		}
+		state.Swap(inv)
+
+		called = false
+		r := httptest.NewRequest("GET", "https://test/?container="+container, nil)
+		r.TLS.PeerCertificates = []*x509.Certificate{cert.Leaf}
+		w := httptest.NewRecorder()
+		fn(w, r, httprouter.Params{{Key: "fingerprint", Value: "node-1"}})
+		return w.Code
+	}
+
+	assert.Equal(t, 403, call(nil, "nginx"))
+	assert.Equal(t, 403, call(&clientGrant{Role: roleViewer}, "nginx"))
+	assert.Equal(t, 200, call(&clientGrant{Role: roleOperator}, "nginx"))
+	assert.True(t, called)
+	assert.Equal(t, 200, call(&clientGrant{Role: roleAdmin}, "nginx"))
+
+	scoped := &clientGrant{Role: roleOperator, Containers: map[string]struct{}{"nginx": {}}}
+	assert.Equal(t, 200, call(scoped, "nginx"))
+	assert.Equal(t, 403, call(scoped, "postgres"))
+	assert.False(t, called)
+}
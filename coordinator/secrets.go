@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jveski/recompose/internal/api"
+)
+
+// secretBackend decrypts the ciphertext of secrets that reference it by provider name.
+type secretBackend interface {
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// ageBackend decrypts age-encrypted ciphertext using a local identity file.
+type ageBackend struct {
+	IdentityFile string
+}
+
+func (a *ageBackend) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "age", "--decrypt", "--identity="+a.IdentityFile)
+	cmd.Stdin = bytes.NewReader(ciphertext)
+	out, err := runSecretCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(out, []byte("\n")), nil // trim off trailing newline
+}
+
+// sopsBackend decrypts SOPS-encrypted files in the repo.
+// The ciphertext is the file's path relative to the repo root, optionally followed by `#key` to extract a single value.
+type sopsBackend struct {
+	Dir string
+}
+
+func (s *sopsBackend) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	path, key, _ := strings.Cut(strings.TrimSpace(string(ciphertext)), "#")
+	file, err := resolveLocalPath(s.Dir, path)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"--decrypt"}
+	if key != "" {
+		args = append(args, fmt.Sprintf("--extract=[%q]", key))
+	}
+	args = append(args, file)
+
+	return runSecretCommand(exec.CommandContext(ctx, "sops", args...))
+}
+
+// fileBackend reads plaintext secrets from a local directory.
+// The ciphertext is the name of the file. Useful for dev clusters.
+type fileBackend struct {
+	Dir string
+}
+
+func (f *fileBackend) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	file, err := resolveLocalPath(f.Dir, strings.TrimSpace(string(ciphertext)))
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf, []byte("\n")), nil
+}
+
+// execBackend passes the ciphertext to a helper binary's stdin and returns its stdout.
+type execBackend struct {
+	Command []string
+}
+
+func (e *execBackend) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, e.Command[0], e.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(ciphertext)
+	return runSecretCommand(cmd)
+}
+
+// decryptRegistryCredentials returns the username and password of a registry declared in cluster.toml.
+func decryptRegistryCredentials(ctx context.Context, backends map[string]secretBackend, registry *api.Registry) (string, string, error) {
+	provider := registry.Provider
+	if provider == "" {
+		provider = "age"
+	}
+	backend, ok := backends[provider]
+	if !ok {
+		return "", "", fmt.Errorf("unknown secret provider %q", provider)
+	}
+
+	username, err := backend.Decrypt(ctx, []byte(registry.Username))
+	if err != nil {
+		return "", "", fmt.Errorf("decrypting username of registry %q: %w", registry.Hostname, err)
+	}
+	password, err := backend.Decrypt(ctx, []byte(registry.Password))
+	if err != nil {
+		return "", "", fmt.Errorf("decrypting password of registry %q: %w", registry.Hostname, err)
+	}
+	return string(username), string(password), nil
+}
+
+func runSecretCommand(cmd *exec.Cmd) ([]byte, error) {
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s - %s", err, stderr)
+	}
+	return out, nil
+}
+
+// resolveLocalPath joins dir and the relative path while making sure the result doesn't escape dir.
+func resolveLocalPath(dir, path string) (string, error) {
+	clean := filepath.Clean(path)
+	if path == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.New("invalid secret path")
+	}
+	return filepath.Join(dir, clean), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileBackend(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "db-password"), []byte("hunter2\n"), 0600))
+	backend := &fileBackend{Dir: dir}
+
+	out, err := backend.Decrypt(context.Background(), []byte("db-password"))
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", string(out))
+
+	_, err = backend.Decrypt(context.Background(), []byte("../db-password"))
+	assert.EqualError(t, err, "invalid secret path")
+
+	_, err = backend.Decrypt(context.Background(), []byte("/etc/passwd"))
+	assert.EqualError(t, err, "invalid secret path")
+}
+
+func TestExecBackend(t *testing.T) {
+	backend := &execBackend{Command: []string{"cat"}}
+	out, err := backend.Decrypt(context.Background(), []byte("test-ciphertext"))
+	require.NoError(t, err)
+	assert.Equal(t, "test-ciphertext", string(out))
+
+	backend = &execBackend{Command: []string{"false"}}
+	_, err = backend.Decrypt(context.Background(), []byte("test-ciphertext"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/api"
+)
+
+const (
+	maxPushSize      = 1 << 26 // compressed
+	maxExtractedSize = 1 << 28
+)
+
+// inventorySource fetches the latest inventory into a local directory.
+type inventorySource interface {
+	// Dir is the directory holding the inventory i.e. cluster.toml.
+	Dir() string
+
+	// Sync fetches the latest inventory and returns its version.
+	Sync() (string, error)
+}
+
+// gitSource fetches the inventory from a git repo. The version is the SHA of HEAD.
+type gitSource struct {
+	Path   string
+	URL    string // cloned into Path if it isn't already a repo
+	Ref    string // branch or tag - defaults to the upstream of the current branch
+	Subdir string // relative path of the directory holding cluster.toml, i.e. when a repo serves multiple clusters
+
+	// Commits are only checked out when signed by a key in one of these (when set)
+	AllowedSigners string // ssh allowed signers file
+	GPGHome        string // GnuPG home directory containing a keyring
+
+	PinFile string // persists the commit set by `rectl pin` across restarts
+	pinLock sync.Mutex
+	pin     string
+}
+
+func (g *gitSource) Dir() string { return filepath.Join(g.Path, g.Subdir) }
+
+func (g *gitSource) Sync() (string, error) {
+	if g.URL != "" {
+		if err := gitClone(g.URL, g.Path); err != nil {
+			return "", fmt.Errorf("cloning git repo: %w", err)
+		}
+	}
+
+	// Pinned commits are resolved from local objects so they're still deployed while the remote is unreachable
+	sha, err := g.resolvePin()
+	if err != nil {
+		return "", err
+	}
+	if sha == "" {
+		sha, err = gitFetch(g.Path, g.Ref)
+		if err != nil {
+			return "", fmt.Errorf("fetching git repo: %w", err)
+		}
+	}
+
+	// Verify before checking out so secret providers never read files from unverified commits
+	if g.AllowedSigners != "" || g.GPGHome != "" {
+		if err := gitVerifyCommit(g.Path, sha, g.AllowedSigners, g.GPGHome); err != nil {
+			return "", err
+		}
+	}
+
+	if err := gitCheckout(g.Path, sha); err != nil {
+		return "", fmt.Errorf("checking out git repo: %w", err)
+	}
+	return sha, nil
+}
+
+// dirSource reads the inventory from a plain directory. The version is a hash of its contents.
+// Useful for local development and tests.
+type dirSource struct {
+	Path string
+}
+
+func (d *dirSource) Dir() string { return d.Path }
+
+func (d *dirSource) Sync() (string, error) { return hashDir(d.Path) }
+
+// hashDir returns a hash of the names, types, and contents of every file in the directory tree.
+func hashDir(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%q %s\n", filepath.ToSlash(rel), d.Type())
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pushSource serves the inventory from the last tarball uploaded by `rectl push`.
+// Tarballs must be signed by an SSH key listed in the allowed signers file.
+//
+// Each push is extracted to its own directory, and Path/current is a symlink to the latest one.
+// Pushes replace the symlink atomically, and the directory seen by the last sync is kept until
+// the next push so it can still be read after being replaced.
+type pushSource struct {
+	Path           string
+	AllowedSigners string
+
+	lock sync.Mutex
+	dir  string // directory of the last synced push
+}
+
+func (p *pushSource) Dir() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.dir == "" {
+		return filepath.Join(p.Path, "current")
+	}
+	return p.dir
+}
+
+// Sync hashes the latest push. The version is empty until something has been pushed.
+func (p *pushSource) Sync() (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	current := filepath.Join(p.Path, "current")
+	dir := current
+	if target, err := os.Readlink(current); err == nil {
+		dir = filepath.Join(p.Path, target)
+	} else if _, err := os.Stat(current); os.IsNotExist(err) {
+		p.dir = ""
+		return "", nil // nothing has been pushed yet
+	}
+
+	version, err := hashDir(dir)
+	if err != nil {
+		return "", err
+	}
+	p.dir = dir
+	return version, nil
+}
+
+// Push verifies the signature of the gzipped tarball and replaces the current inventory with its contents.
+// Returns the principal that signed the tarball.
+func (p *pushSource) Push(tarball, signature []byte) (string, error) {
+	principal, err := verifySSHSignature(p.AllowedSigners, api.PushSignatureNamespace, tarball, signature)
+	if err != nil {
+		return "", err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := os.MkdirAll(p.Path, 0755); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(p.Path, "push-")
+	if err != nil {
+		return "", err
+	}
+	if err := extractTarball(bytes.NewReader(tarball), dir); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("extracting tarball: %w", err)
+	}
+
+	// Replace the symlink rather than extracting in place so syncs never see partial pushes
+	current := filepath.Join(p.Path, "current")
+	if info, err := os.Lstat(current); err == nil && info.IsDir() {
+		os.RemoveAll(current) // extracted in place by older versions
+	}
+	link := filepath.Join(p.Path, "next")
+	os.Remove(link)
+	if err := os.Symlink(filepath.Base(dir), link); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	if err := os.Rename(link, current); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	// Clean up pushes that are no longer current or being read
+	prev, _ := filepath.Glob(filepath.Join(p.Path, "push-*"))
+	for _, path := range prev {
+		if path != dir && path != p.dir {
+			os.RemoveAll(path)
+		}
+	}
+
+	return principal, nil
+}
+
+// verifySSHSignature returns the principal of the allowed signer that signed the message.
+func verifySSHSignature(allowedSigners, namespace string, msg, signature []byte) (string, error) {
+	sigFile, err := os.CreateTemp("", "recompose-signature-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(sigFile.Name())
+	if _, err := sigFile.Write(signature); err != nil {
+		sigFile.Close()
+		return "", err
+	}
+	sigFile.Close()
+
+	cmd := exec.Command("ssh-keygen", "-Y", "find-principals", "-f", allowedSigners, "-s", sigFile.Name())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("signer is not allowed: %s", bytes.TrimSpace(out))
+	}
+	principal, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+
+	cmd = exec.Command("ssh-keygen", "-Y", "verify", "-f", allowedSigners, "-I", principal, "-n", namespace, "-s", sigFile.Name())
+	cmd.Stdin = bytes.NewReader(msg)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("invalid signature: %s", bytes.TrimSpace(out))
+	}
+	return principal, nil
+}
+
+// extractTarball writes the regular files and directories of a gzipped tarball into the given directory.
+// Other types of entries (i.e. symlinks) are rejected, as are paths that would escape the directory.
+func extractTarball(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	var total int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path, err := resolveLocalPath(dir, hdr.Name)
+		if err != nil {
+			return fmt.Errorf("invalid path %q", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if total += hdr.Size; total > maxExtractedSize {
+				return errors.New("contents are too large")
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported entry type for %q", hdr.Name)
+		}
+	}
+}
+
+// newPushHandler accepts inventory tarballs uploaded by `rectl push` and triggers a sync.
+func newPushHandler(source *pushSource, signal *syncQueue) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		signature, err := base64.StdEncoding.DecodeString(r.Header.Get(api.PushSignatureHeader))
+		if err != nil || len(signature) == 0 {
+			http.Error(w, "a signature is required", 400)
+			return
+		}
+
+		tarball, err := io.ReadAll(io.LimitReader(r.Body, maxPushSize+1))
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		if len(tarball) > maxPushSize {
+			http.Error(w, "tarball is too large", 413)
+			return
+		}
+
+		start := time.Now()
+		principal, err := source.Push(tarball, signature)
+		if err != nil {
+			log.Printf("rejected inventory push: %s", err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		log.Printf("accepted inventory push signed by %q in %s", principal, time.Since(start))
+
+		signal.Trigger("push")
+	}
+}
+
+func newInventorySource(kind, dir, allowedSigners string, git *gitSource) (inventorySource, error) {
+	switch kind {
+	case "git":
+		if _, err := resolveLocalPath(git.Path, git.Subdir); git.Subdir != "" && err != nil {
+			return nil, fmt.Errorf("invalid --git-subdir %q", git.Subdir)
+		}
+		return git, git.loadPin()
+	case "dir":
+		if dir == "" {
+			return nil, errors.New("--inventory-dir is required when using the dir inventory source")
+		}
+		return &dirSource{Path: dir}, nil
+	case "push":
+		if allowedSigners == "" {
+			return nil, errors.New("--push-allowed-signers is required when using the push inventory source")
+		}
+		return &pushSource{Path: "./pushed", AllowedSigners: allowedSigners}, nil
+	default:
+		return nil, fmt.Errorf("unknown inventory source %q", kind)
+	}
+}
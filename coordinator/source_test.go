@@ -0,0 +1,277 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirSource(t *testing.T) {
+	dir := t.TempDir()
+	source := &dirSource{Path: dir}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cluster.toml"), []byte("[[node]]\n"), 0644))
+
+	v1, err := source.Sync()
+	require.NoError(t, err)
+	v2, err := source.Sync()
+	require.NoError(t, err)
+	assert.Equal(t, v1, v2)
+
+	// Changes to .git are ignored
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, ".git"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte("test"), 0644))
+	v3, err := source.Sync()
+	require.NoError(t, err)
+	assert.Equal(t, v1, v3)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test.toml"), []byte("image = 'test'"), 0644))
+	v4, err := source.Sync()
+	require.NoError(t, err)
+	assert.NotEqual(t, v1, v4)
+}
+
+func TestExtractTarball(t *testing.T) {
+	t.Run("happy path", func(t *testing.T) {
+		dir := t.TempDir()
+		tarball := newTestTarball(t, &tar.Header{Typeflag: tar.TypeDir, Name: "apps/"}, &tar.Header{Typeflag: tar.TypeReg, Name: "apps/test.toml"})
+		require.NoError(t, extractTarball(bytes.NewReader(tarball), dir))
+
+		content, err := os.ReadFile(filepath.Join(dir, "apps", "test.toml"))
+		require.NoError(t, err)
+		assert.Equal(t, "apps/test.toml", string(content))
+	})
+
+	t.Run("path traversal", func(t *testing.T) {
+		tarball := newTestTarball(t, &tar.Header{Typeflag: tar.TypeReg, Name: "../test.toml"})
+		assert.EqualError(t, extractTarball(bytes.NewReader(tarball), t.TempDir()), `invalid path "../test.toml"`)
+	})
+
+	t.Run("symlink", func(t *testing.T) {
+		tarball := newTestTarball(t, &tar.Header{Typeflag: tar.TypeSymlink, Name: "test.toml", Linkname: "/etc/passwd"})
+		assert.EqualError(t, extractTarball(bytes.NewReader(tarball), t.TempDir()), `unsupported entry type for "test.toml"`)
+	})
+}
+
+func TestPushHandler(t *testing.T) {
+	dir := t.TempDir()
+	key := filepath.Join(dir, "id_ed25519")
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "", "-f", key).CombinedOutput()
+	require.NoError(t, err, string(out))
+	pub, err := os.ReadFile(key + ".pub")
+	require.NoError(t, err)
+
+	signers := filepath.Join(dir, "allowed_signers")
+	require.NoError(t, os.WriteFile(signers, append([]byte("test@example.com "), pub...), 0644))
+
+	source := &pushSource{Path: filepath.Join(dir, "pushed"), AllowedSigners: signers}
+	initial, err := source.Sync()
+	require.NoError(t, err)
+	assert.Empty(t, initial)
+	_, err = os.Stat(source.Path)
+	assert.True(t, os.IsNotExist(err), "syncing doesn't create the inventory")
+
+	signal := newSyncQueue()
+	fn := newPushHandler(source, signal)
+	push := func(tarball, signature []byte) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/push", bytes.NewReader(tarball))
+		r.Header.Set(api.PushSignatureHeader, base64.StdEncoding.EncodeToString(signature))
+		fn(w, r, httprouter.Params{})
+		return w.Code
+	}
+
+	tarball := newTestTarball(t, &tar.Header{Typeflag: tar.TypeReg, Name: "cluster.toml"})
+	cmd := exec.Command("ssh-keygen", "-Y", "sign", "-f", key, "-n", api.PushSignatureNamespace)
+	cmd.Stdin = bytes.NewReader(tarball)
+	signature, err := cmd.Output()
+	require.NoError(t, err)
+
+	t.Run("missing signature", func(t *testing.T) {
+		assert.Equal(t, 400, push(tarball, nil))
+	})
+
+	t.Run("tampered tarball", func(t *testing.T) {
+		assert.Equal(t, 400, push(newTestTarball(t, &tar.Header{Typeflag: tar.TypeReg, Name: "other.toml"}), signature))
+		_, err := os.Stat(filepath.Join(source.Dir(), "other.toml"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("happy path", func(t *testing.T) {
+		assert.Equal(t, 200, push(tarball, signature))
+		<-signal.C
+		assert.Equal(t, "push", signal.Take())
+
+		content, err := os.ReadFile(filepath.Join(source.Dir(), "cluster.toml"))
+		require.NoError(t, err)
+		assert.Equal(t, "cluster.toml", string(content))
+
+		version, err := source.Sync()
+		require.NoError(t, err)
+		assert.NotEqual(t, initial, version)
+
+		info, err := os.Lstat(filepath.Join(source.Path, "current"))
+		require.NoError(t, err)
+		assert.Equal(t, os.ModeSymlink, info.Mode().Type())
+	})
+
+	t.Run("push during sync", func(t *testing.T) {
+		synced := source.Dir()
+
+		tarball := newTestTarball(t, &tar.Header{Typeflag: tar.TypeReg, Name: "cluster.toml"}, &tar.Header{Typeflag: tar.TypeReg, Name: "next.toml"})
+		cmd := exec.Command("ssh-keygen", "-Y", "sign", "-f", key, "-n", api.PushSignatureNamespace)
+		cmd.Stdin = bytes.NewReader(tarball)
+		signature, err := cmd.Output()
+		require.NoError(t, err)
+		assert.Equal(t, 200, push(tarball, signature))
+		<-signal.C
+		signal.Take()
+
+		// The directory of the last sync is still readable until the next one
+		assert.Equal(t, synced, source.Dir())
+		_, err = os.Stat(filepath.Join(synced, "cluster.toml"))
+		require.NoError(t, err)
+
+		_, err = source.Sync()
+		require.NoError(t, err)
+		assert.NotEqual(t, synced, source.Dir())
+		_, err = os.Stat(filepath.Join(source.Dir(), "next.toml"))
+		require.NoError(t, err)
+	})
+}
+
+// newTestTarball returns a gzipped tarball of the given entries. Regular files contain their own name.
+func newTestTarball(t *testing.T, hdrs ...*tar.Header) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range hdrs {
+		hdr.Mode = 0644
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(hdr.Name))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestGitSource(t *testing.T) {
+	dir := t.TempDir()
+	upstream := filepath.Join(dir, "upstream")
+	commit := func(branch, file, content string) {
+		t.Helper()
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(upstream, file)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(upstream, file), []byte(content), 0644))
+		for _, args := range [][]string{{"checkout", "-q", "-B", branch}, {"add", "-A"}, {"commit", "-q", "-m", file}} {
+			_, err := runGit(upstream, append([]string{"-c", "user.name=test", "-c", "user.email=test@test"}, args...)...)
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, os.MkdirAll(upstream, 0755))
+	_, err := runGit(upstream, "init", "-q")
+	require.NoError(t, err)
+	commit("main", "cluster-a/cluster.toml", "# main")
+
+	source := &gitSource{Path: filepath.Join(dir, "repo"), URL: upstream, Ref: "main", Subdir: "cluster-a"}
+	v1, err := source.Sync()
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(source.Dir(), "cluster.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, "# main", string(content))
+
+	// Local drift is discarded
+	require.NoError(t, os.WriteFile(filepath.Join(source.Dir(), "cluster.toml"), []byte("# drift"), 0644))
+	commit("main", "cluster-a/cluster.toml", "# main 2")
+	v2, err := source.Sync()
+	require.NoError(t, err)
+	assert.NotEqual(t, v1, v2)
+
+	content, err = os.ReadFile(filepath.Join(source.Dir(), "cluster.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, "# main 2", string(content))
+
+	// Switching refs doesn't require a new clone
+	commit("staging", "cluster-a/cluster.toml", "# staging")
+	source.Ref = "staging"
+	_, err = source.Sync()
+	require.NoError(t, err)
+
+	content, err = os.ReadFile(filepath.Join(source.Dir(), "cluster.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, "# staging", string(content))
+}
+
+func TestGitSourceSignedCommits(t *testing.T) {
+	dir := t.TempDir()
+	key := filepath.Join(dir, "id_ed25519")
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "", "-f", key).CombinedOutput()
+	require.NoError(t, err, string(out))
+	pub, err := os.ReadFile(key + ".pub")
+	require.NoError(t, err)
+
+	signers := filepath.Join(dir, "allowed_signers")
+	require.NoError(t, os.WriteFile(signers, append([]byte("test@test "), pub...), 0644))
+
+	// A key that isn't in the allowed signers file
+	otherKey := filepath.Join(dir, "other_ed25519")
+	out, err = exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "", "-f", otherKey).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	upstream := filepath.Join(dir, "upstream")
+	commit := func(content string, signingKey string) {
+		t.Helper()
+		require.NoError(t, os.WriteFile(filepath.Join(upstream, "cluster.toml"), []byte(content), 0644))
+		args := []string{"-c", "user.name=test", "-c", "user.email=test@test", "-c", "gpg.format=ssh", "-c", "user.signingkey=" + signingKey, "commit", "-q", "-m", content}
+		if signingKey != "" {
+			args = append(args, "-S")
+		}
+		for _, args := range [][]string{{"add", "-A"}, args} {
+			_, err := runGit(upstream, args...)
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, os.MkdirAll(upstream, 0755))
+	_, err = runGit(upstream, "init", "-q", "-b", "main")
+	require.NoError(t, err)
+	commit("# signed", key)
+
+	source := &gitSource{Path: filepath.Join(dir, "repo"), URL: upstream, Ref: "main", AllowedSigners: signers}
+	_, err = source.Sync()
+	require.NoError(t, err)
+
+	commit("# unsigned", "")
+	_, err = source.Sync()
+	assert.ErrorContains(t, err, "is not signed by an allowed signer")
+
+	// The working tree isn't updated
+	content, err := os.ReadFile(filepath.Join(source.Dir(), "cluster.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, "# signed", string(content))
+
+	commit("# wrong signer", otherKey)
+	_, err = source.Sync()
+	assert.ErrorContains(t, err, "is not signed by an allowed signer")
+
+	content, err = os.ReadFile(filepath.Join(source.Dir(), "cluster.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, "# signed", string(content))
+}
@@ -17,6 +17,12 @@ func (n *nodeMetadataStore) Set(fingerprint string, meta *nodeMetadata) {
 	n.byFingerprint[fingerprint] = meta
 }
 
+func (n *nodeMetadataStore) Delete(fingerprint string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.byFingerprint, fingerprint)
+}
+
 func (n *nodeMetadataStore) Get(fingerprint string) *nodeMetadata {
 	n.lock.Lock()
 	defer n.lock.Unlock()
@@ -36,6 +42,25 @@ func (n *nodeMetadataStore) List() []*nodeMetadata {
 
 type nodeMetadata struct {
 	Fingerprint string
-	IP          string
+	IPs         []string // in order of preference
 	APIPort     uint
+	Trusts      []string // coordinator cert fingerprints trusted by the agent
+	Platform    string   // os/arch of the node i.e. linux/arm64
+}
+
+// TrustsAll returns true when the agent trusts every given coordinator cert fingerprint.
+func (n *nodeMetadata) TrustsAll(fingerprints ...string) bool {
+	for _, fingerprint := range fingerprints {
+		var found bool
+		for _, trusted := range n.Trusts {
+			if trusted == fingerprint {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
 }
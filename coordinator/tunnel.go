@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/jveski/recompose/internal/rpc"
+)
+
+// newTunnelHandler adds connections opened by agents to the tunnel pool.
+// Tunnels are keyed the same way as node metadata: by name for CA-issued certs, otherwise by fingerprint.
+func newTunnelHandler(tunnels *rpc.TunnelPool) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		q := r.URL.Query()
+		key := q.Get("fingerprint")
+		if name := q.Get("name"); name != "" {
+			key = name
+		}
+
+		if err := tunnels.Accept(key, w, r); err != nil {
+			log.Printf("error while accepting tunnel from node %s: %s", key, err)
+			http.Error(w, err.Error(), 400)
+		}
+	}
+}
+
+const (
+	agentDialTimeout    = time.Second * 10
+	minAgentDialTimeout = time.Second * 2
+)
+
+// agentDialer connects to agents over the tunnels they've opened, falling back to dialing their registered API port.
+// Requests to agents use the node's metadata key as the URL host i.e. https://<fingerprint>/ps.
+type agentDialer struct {
+	Container inventoryContainer
+	Store     *nodeMetadataStore
+	Tunnels   *rpc.TunnelPool
+	TLS       *tls.Config
+}
+
+func (a *agentDialer) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	key, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tunnels are only authorized when they're opened, so make sure the node hasn't been removed since
+	if a.Container.Get().Node(key, key) == nil {
+		return nil, fmt.Errorf("node %q is not in the inventory", key)
+	}
+	if conn := a.Tunnels.Take(key); conn != nil {
+		return conn, nil
+	}
+
+	meta := a.Store.Get(key)
+	if meta == nil || meta.APIPort == 0 || len(meta.IPs) == 0 {
+		return nil, fmt.Errorf("node %q has no open tunnels or reachable API port", key)
+	}
+
+	// Try each of the node's addresses in order, giving each a slice of the time remaining
+	// so an unreachable address doesn't starve the ones after it
+	dialer := &tls.Dialer{Config: a.TLS}
+	for i, ip := range meta.IPs {
+		var conn net.Conn
+		dialCtx, done := context.WithTimeout(ctx, dialTimeout(ctx, len(meta.IPs)-i))
+		conn, err = dialer.DialContext(dialCtx, network, net.JoinHostPort(ip, strconv.Itoa(int(meta.APIPort))))
+		done()
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dialTimeout returns the timeout for the next of the given number of remaining dial attempts.
+func dialTimeout(ctx context.Context, remaining int) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return agentDialTimeout
+	}
+	timeout := time.Until(deadline) / time.Duration(remaining)
+	if timeout < minAgentDialTimeout {
+		timeout = minAgentDialTimeout // the parent context still bounds the total
+	}
+	return timeout
+}
@@ -1,26 +1,92 @@
 package api
 
+import "time"
+
 type NodeInventory struct {
-	GitSHA     string           `toml:"gitSHA"`
-	Containers []*ContainerSpec `toml:"container"`
+	GitSHA     string            `toml:"gitSHA"`
+	Vars       map[string]string `toml:"vars"` // cluster-level variables used when rendering templates
+	Containers []*ContainerSpec  `toml:"container"`
+	Registries []*Registry       `toml:"registry"` // credentials of the registries hosting the containers' images
+}
+
+// Registry holds the encrypted credentials used to pull images from a private registry.
+type Registry struct {
+	Hostname string `toml:"hostname"` // i.e. ghcr.io or docker.io
+	Username string `toml:"username"` // ciphertext
+	Password string `toml:"password"` // ciphertext
+	Provider string `toml:"provider"` // backend used to decrypt the ciphertext - defaults to age
 }
 
 type ContainerSpec struct {
-	Name    string         `toml:"name"` // derived from filename
-	Hash    string         `toml:"hash"` // generated when reading
+	Name string `toml:"name"` // derived from filename
+	Hash string `toml:"hash"` // generated when reading - prefixed with the hash algorithm's version
+
+	// Hashes of the spec generated by previous versions of the hash algorithm, oldest first.
+	// Containers labeled with any of them are adopted rather than recreated. The first is the md5 of the file's bytes.
+	PreviousHashes []string `toml:"previousHashes"`
+
 	Image   string         `toml:"image"`
 	Command []string       `toml:"command"`
 	Flags   map[string]any `toml:"flags"`
 	Secrets []*Secret      `toml:"secret"`
 	Files   []*File        `toml:"file"`
+
+	// stop-first (default) removes the previous container before starting the new one.
+	// start-first starts the new one under a temporary name and swaps it in once it's running and healthy.
+	UpdateStrategy string `toml:"update_strategy"`
+
+	// When set to "track", the coordinator periodically resolves the image's tag and serves the digest it points to,
+	// so pushing a new image to the tag recreates the container.
+	ImagePolicy string `toml:"image_policy"`
+	ImageDigest string `toml:"imageDigest"` // set by the coordinator for tracked images
 }
 
 type Secret struct {
 	EnvVar     string `toml:"envvar"`
+	Name       string `toml:"name"` // references a shared secret declared in cluster.toml
 	Ciphertext string `toml:"ciphertext"`
+	Provider   string `toml:"provider"` // backend used to decrypt the ciphertext - defaults to age
 }
 
 type File struct {
-	Path    string `toml:"path"`
-	Content string `toml:"content"`
+	Path     string `toml:"path"`
+	Content  string `toml:"content"`
+	Template bool   `toml:"template"` // render content as a Go template on the agent
+}
+
+// Inventory tarballs uploaded by `rectl push` are signed using `ssh-keygen -Y sign` in this namespace.
+// The base64-encoded signature is sent in the PushSignatureHeader.
+const (
+	PushSignatureNamespace = "recompose-push"
+	PushSignatureHeader    = "X-Recompose-Signature"
+)
+
+// SyncStatus describes the coordinator's most recent attempt to sync the inventory.
+type SyncStatus struct {
+	Version string    `toml:"version"` // of the inventory currently being served
+	Time    time.Time `toml:"time"`
+	Error   string    `toml:"error"`  // empty when the attempt succeeded
+	Pinned  string    `toml:"pinned"` // commit deployed regardless of the latest commit (if any) - set by `rectl pin`
+}
+
+// Deployment is an entry in the coordinator's history of inventory changes.
+type Deployment struct {
+	Version string         `toml:"version"`
+	Time    time.Time      `toml:"time"`
+	Trigger string         `toml:"trigger"` // startup, poll, webhook, push, pin, unpin, rollback, or digest
+	Author  string         `toml:"author,omitempty"`
+	Message string         `toml:"message,omitempty"`
+	Nodes   []*NodeChanges `toml:"node,omitempty"` // only nodes with changes are included
+}
+
+// NodeChanges lists the containers of a node that changed in a deployment.
+type NodeChanges struct {
+	Node    string   `toml:"node"` // name or fingerprint
+	Added   []string `toml:"added,omitempty"`
+	Changed []string `toml:"changed,omitempty"`
+	Removed []string `toml:"removed,omitempty"`
+}
+
+type DeploymentHistory struct {
+	Deployments []*Deployment `toml:"deployment"`
 }
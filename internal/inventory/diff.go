@@ -0,0 +1,60 @@
+package inventory
+
+import (
+	"sort"
+
+	"github.com/jveski/recompose/internal/api"
+)
+
+// Diff returns the containers added, changed, or removed on each node between two sets of node inventories keyed by node ID.
+// Containers are considered changed when their hash differs. Nodes without changes are omitted.
+func Diff(prev, next map[string]*api.NodeInventory) []*api.NodeChanges {
+	ids := map[string]struct{}{}
+	for _, nodes := range []map[string]*api.NodeInventory{prev, next} {
+		for id := range nodes {
+			ids[id] = struct{}{}
+		}
+	}
+
+	changes := []*api.NodeChanges{}
+	for id := range ids {
+		before := containerHashes(prev[id])
+		after := containerHashes(next[id])
+
+		c := &api.NodeChanges{Node: id}
+		for name, hash := range after {
+			if prevHash, ok := before[name]; !ok {
+				c.Added = append(c.Added, name)
+			} else if prevHash != hash {
+				c.Changed = append(c.Changed, name)
+			}
+		}
+		for name := range before {
+			if _, ok := after[name]; !ok {
+				c.Removed = append(c.Removed, name)
+			}
+		}
+		if len(c.Added)+len(c.Changed)+len(c.Removed) == 0 {
+			continue
+		}
+
+		sort.Strings(c.Added)
+		sort.Strings(c.Changed)
+		sort.Strings(c.Removed)
+		changes = append(changes, c)
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Node < changes[j].Node })
+	return changes
+}
+
+func containerHashes(inv *api.NodeInventory) map[string]string {
+	hashes := map[string]string{}
+	if inv == nil {
+		return hashes
+	}
+	for _, container := range inv.Containers {
+		hashes[container.Name] = container.Hash
+	}
+	return hashes
+}
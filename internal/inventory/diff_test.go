@@ -0,0 +1,30 @@
+package inventory
+
+import (
+	"testing"
+
+	"github.com/jveski/recompose/internal/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	prev := map[string]*api.NodeInventory{
+		"node-1": {Containers: []*api.ContainerSpec{{Name: "a", Hash: "1"}, {Name: "b", Hash: "1"}, {Name: "c", Hash: "1"}}},
+		"node-2": {Containers: []*api.ContainerSpec{{Name: "a", Hash: "1"}}},
+		"node-3": {Containers: []*api.ContainerSpec{{Name: "a", Hash: "1"}}},
+	}
+	next := map[string]*api.NodeInventory{
+		"node-1": {Containers: []*api.ContainerSpec{{Name: "b", Hash: "2"}, {Name: "c", Hash: "1"}, {Name: "d", Hash: "1"}}},
+		"node-2": {Containers: []*api.ContainerSpec{{Name: "a", Hash: "1"}}},
+		"node-4": {Containers: []*api.ContainerSpec{{Name: "a", Hash: "1"}}},
+	}
+
+	assert.Equal(t, []*api.NodeChanges{
+		{Node: "node-1", Added: []string{"d"}, Changed: []string{"b"}, Removed: []string{"a"}},
+		{Node: "node-3", Removed: []string{"a"}},
+		{Node: "node-4", Added: []string{"a"}},
+	}, Diff(prev, next))
+
+	// Every container is added when there's no previous inventory
+	assert.Len(t, Diff(nil, prev), 3)
+}
@@ -0,0 +1,61 @@
+package inventory
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/jveski/recompose/internal/api"
+)
+
+// ImageRef is a parsed container image reference i.e. ghcr.io/org/app:1.0.
+type ImageRef struct {
+	Name       string // as written, without the tag or digest
+	Registry   string // i.e. docker.io
+	Repository string // i.e. library/nginx
+	Tag        string // defaults to latest
+	Digest     string // i.e. sha256:...
+}
+
+// ParseImage splits an image reference into its parts, applying the same defaults as podman and docker.
+func ParseImage(image string) *ImageRef {
+	ref := &ImageRef{Name: image}
+	ref.Name, ref.Digest, _ = strings.Cut(ref.Name, "@")
+	if i := strings.LastIndex(ref.Name, ":"); i > strings.LastIndex(ref.Name, "/") {
+		ref.Name, ref.Tag = ref.Name[:i], ref.Name[i+1:]
+	}
+	if ref.Tag == "" {
+		ref.Tag = "latest"
+	}
+
+	ref.Registry, ref.Repository, _ = strings.Cut(ref.Name, "/")
+	if ref.Repository == "" || !strings.ContainsAny(ref.Registry, ".:") && ref.Registry != "localhost" {
+		ref.Registry, ref.Repository = "docker.io", ref.Name
+	}
+	if ref.Registry == "docker.io" && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+	return ref
+}
+
+// IsTracked returns true when the container's image should follow the digest its tag resolves to.
+func IsTracked(spec *api.ContainerSpec) bool {
+	return spec.ImagePolicy == "track" && ParseImage(spec.Image).Digest == ""
+}
+
+// PinDigest sets the digest a tracked container's image tag currently resolves to.
+// The digest is folded into the hash so pushing a new image to the tag rolls out like any other change.
+func PinDigest(spec *api.ContainerSpec, digest string) {
+	sum := sha256.Sum256([]byte(spec.Hash + "\n" + digest))
+	spec.Hash = HashVersion + "-" + hex.EncodeToString(sum[:])
+	spec.ImageDigest = digest
+	spec.PreviousHashes = nil // the digest of containers created before tracking was supported is unknown
+}
+
+// ResolvedImage returns the reference the container should be created from: the image pinned to its tracked digest (if any).
+func ResolvedImage(spec *api.ContainerSpec) string {
+	if spec.ImageDigest == "" {
+		return spec.Image
+	}
+	return ParseImage(spec.Image).Name + "@" + spec.ImageDigest
+}
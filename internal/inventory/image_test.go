@@ -0,0 +1,40 @@
+package inventory
+
+import (
+	"testing"
+
+	"github.com/jveski/recompose/internal/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImage(t *testing.T) {
+	tests := []struct {
+		Image    string
+		Expected ImageRef
+	}{
+		{Image: "nginx", Expected: ImageRef{Name: "nginx", Registry: "docker.io", Repository: "library/nginx", Tag: "latest"}},
+		{Image: "grafana/grafana:10.0", Expected: ImageRef{Name: "grafana/grafana", Registry: "docker.io", Repository: "grafana/grafana", Tag: "10.0"}},
+		{Image: "ghcr.io/org/app:v1", Expected: ImageRef{Name: "ghcr.io/org/app", Registry: "ghcr.io", Repository: "org/app", Tag: "v1"}},
+		{Image: "localhost:5000/app", Expected: ImageRef{Name: "localhost:5000/app", Registry: "localhost:5000", Repository: "app", Tag: "latest"}},
+		{Image: "localhost/app@sha256:abc", Expected: ImageRef{Name: "localhost/app", Registry: "localhost", Repository: "app", Tag: "latest", Digest: "sha256:abc"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Image, func(t *testing.T) {
+			assert.Equal(t, &tc.Expected, ParseImage(tc.Image))
+		})
+	}
+}
+
+func TestPinDigest(t *testing.T) {
+	spec := &api.ContainerSpec{Image: "ghcr.io/org/app:v1", Hash: "v2-test", PreviousHashes: []string{"legacy"}, ImagePolicy: "track"}
+	assert.True(t, IsTracked(spec))
+	assert.Equal(t, "ghcr.io/org/app:v1", ResolvedImage(spec))
+
+	PinDigest(spec, "sha256:abc")
+	assert.NotEqual(t, "v2-test", spec.Hash)
+	assert.Empty(t, spec.PreviousHashes)
+	assert.Equal(t, "ghcr.io/org/app@sha256:abc", ResolvedImage(spec))
+
+	// Images already pinned to a digest aren't tracked
+	assert.False(t, IsTracked(&api.ContainerSpec{Image: "app@sha256:abc", ImagePolicy: "track"}))
+}
@@ -0,0 +1,438 @@
+// Package inventory reads the GitOps repo layout: a cluster.toml that assigns container files to nodes.
+package inventory
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/jveski/recompose/internal/api"
+)
+
+// ReadCluster decodes the cluster.toml in the given directory.
+// Errors satisfy os.IsNotExist when the file doesn't exist.
+func ReadCluster(dir string) (*ClusterSpec, error) {
+	cluster := &ClusterSpec{}
+	if _, err := toml.DecodeFile(filepath.Join(dir, "cluster.toml"), cluster); err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
+
+// BuildNode reads the container files assigned to the given node.
+// Invalid container files are logged and skipped so they don't affect the rest of the node's containers.
+// The cache is keyed by container file path and can be shared between calls for the same cluster.
+func BuildNode(dir string, cluster *ClusterSpec, node *NodeSpec, version string, cache map[string]*api.ContainerSpec) *api.NodeInventory {
+	nodeInv := &api.NodeInventory{GitSHA: version, Vars: cluster.Vars}
+	for _, path := range node.Containers {
+		if container, ok := cache[path]; ok {
+			nodeInv.Containers = append(nodeInv.Containers, container)
+			continue
+		}
+
+		container, err := ReadContainerSpec(filepath.Join(dir, path))
+		if err != nil {
+			log.Printf("error while reading container file %q referenced by node %q: %s", path, node.ID(), err)
+			continue
+		}
+		if err := ResolveSharedSecrets(container, cluster); err != nil {
+			log.Printf("error while resolving secrets of container file %q referenced by node %q: %s", path, node.ID(), err)
+			continue
+		}
+		var vars map[string]string
+		if HasTemplates(container) {
+			vars = cluster.Vars
+			foldLegacyHash(container, vars)
+		}
+		if container.Hash, err = SpecHash(dir, container, vars); err != nil {
+			log.Printf("error while hashing container file %q referenced by node %q: %s", path, node.ID(), err)
+			continue
+		}
+		cache[path] = container
+		nodeInv.Containers = append(nodeInv.Containers, container)
+	}
+	nodeInv.Registries = findRegistries(cluster, nodeInv.Containers)
+	return nodeInv
+}
+
+// findRegistries returns the credentials of the registries hosting the given containers' images.
+func findRegistries(cluster *ClusterSpec, containers []*api.ContainerSpec) []*api.Registry {
+	var registries []*api.Registry
+	seen := map[string]bool{}
+	for _, container := range containers {
+		hostname := ParseImage(container.Image).Registry
+		if seen[hostname] {
+			continue
+		}
+		seen[hostname] = true
+
+		if registry := cluster.FindRegistry(hostname); registry != nil {
+			registries = append(registries, registry)
+		}
+	}
+	return registries
+}
+
+// Node pairs a node declared in cluster.toml with the inventory served to it.
+type Node struct {
+	Spec      *NodeSpec
+	Inventory *api.NodeInventory
+}
+
+// BuildNodes reads the inventory of every node in the cluster.
+// Nodes without a name or fingerprint are skipped since agents can't be matched to them.
+func BuildNodes(dir string, cluster *ClusterSpec, version string) []*Node {
+	cache := map[string]*api.ContainerSpec{}
+	nodes := []*Node{}
+	for _, node := range cluster.Nodes {
+		if len(node.AllFingerprints()) == 0 && node.Name == "" {
+			continue
+		}
+		nodes = append(nodes, &Node{Spec: node, Inventory: BuildNode(dir, cluster, node, version, cache)})
+	}
+	return nodes
+}
+
+// ReadDir reads every container file in the given directory as the inventory of a single node.
+// This is useful when a directory holds the containers of one node rather than a whole cluster.
+func ReadDir(dir, version string) (*api.NodeInventory, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &NodeSpec{Name: dir}
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".toml" {
+			continue
+		}
+		node.Containers = append(node.Containers, entry.Name())
+	}
+	return BuildNode(dir, &ClusterSpec{}, node, version, map[string]*api.ContainerSpec{}), nil
+}
+
+func ReadContainerSpec(file string) (*api.ContainerSpec, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("opening file: %w", err)
+	}
+	defer f.Close()
+
+	hash := md5.New()
+	r := io.TeeReader(f, hash)
+
+	spec := &api.ContainerSpec{}
+	if _, err := toml.NewDecoder(r).Decode(spec); err != nil {
+		return nil, err
+	}
+
+	// Invalid policies fall back to the defaults rather than dropping the container from the inventory,
+	// which would cause agents to remove it
+	if err := validateUpdateStrategy(spec); err != nil {
+		log.Printf("falling back to update_strategy \"stop-first\" for container file %q: %s", file, err)
+		spec.UpdateStrategy = ""
+	}
+	if spec.ImagePolicy != "" && spec.ImagePolicy != "track" {
+		log.Printf("ignoring unknown image_policy %q of container file %q", spec.ImagePolicy, file)
+		spec.ImagePolicy = ""
+	}
+
+	fileName := path.Base(file)
+	spec.Name = fileName[:len(fileName)-len(path.Ext(fileName))]
+	spec.PreviousHashes = []string{hex.EncodeToString(hash.Sum(nil))}
+
+	return spec, nil
+}
+
+// validateUpdateStrategy makes sure start-first is only used by containers that don't bind fixed host ports,
+// since the previous container would still hold them when the new one starts.
+func validateUpdateStrategy(spec *api.ContainerSpec) error {
+	switch spec.UpdateStrategy {
+	case "", "stop-first":
+		return nil
+	case "start-first":
+	default:
+		return fmt.Errorf("unknown update_strategy %q", spec.UpdateStrategy)
+	}
+
+	for key, val := range spec.Flags {
+		values, ok := val.([]any)
+		if !ok {
+			values = []any{val}
+		}
+		for _, value := range values {
+			str := fmt.Sprint(value)
+			switch key {
+			case "network", "net":
+				if str == "host" {
+					return fmt.Errorf("update_strategy \"start-first\" can't be used with host networking")
+				}
+			case "publish", "p":
+				// [[ip:][hostPort]:]containerPort
+				parts := strings.Split(str, ":")
+				if len(parts) > 1 && parts[len(parts)-2] != "" {
+					return fmt.Errorf("update_strategy \"start-first\" can't be used with fixed host ports (%s)", str)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// HashVersion prefixes container hashes generated by SpecHash.
+// Bump it when changing the hash algorithm, and add the hash generated by the previous version to the spec's
+// PreviousHashes so agents adopt existing containers instead of recreating them.
+const HashVersion = "v2"
+
+// canonicalSpec is the form of a container spec hashed by SpecHash.
+// Fields are listed explicitly and omitted when empty, so adding a field to api.ContainerSpec
+// doesn't change the hash of every existing container.
+type canonicalSpec struct {
+	Name    string            `json:"name"`
+	Image   string            `json:"image"`
+	Command []string          `json:"command,omitempty"`
+	Flags   map[string]any    `json:"flags,omitempty"`
+	Secrets []canonicalSecret `json:"secrets,omitempty"`
+	Files   []canonicalFile   `json:"files,omitempty"`
+	Vars    map[string]string `json:"vars,omitempty"`
+	Refs    map[string]string `json:"refs,omitempty"` // sha256 of the referenced sops files
+}
+
+type canonicalSecret struct {
+	EnvVar     string `json:"envvar"`
+	Name       string `json:"name,omitempty"`
+	Ciphertext string `json:"ciphertext"`
+	Provider   string `json:"provider,omitempty"`
+}
+
+type canonicalFile struct {
+	Path     string `json:"path"`
+	Content  string `json:"content"`
+	Template bool   `json:"template,omitempty"`
+}
+
+// SpecHash returns the hash of a container's parsed (and resolved) spec.
+// Unlike the hash of the file bytes, it isn't affected by comments or formatting.
+// The content of SOPS files referenced by the container's secrets is included,
+// as are the given vars, which should only be set for containers that render templates.
+// Fields that don't affect the container itself i.e. the update strategy aren't included.
+func SpecHash(dir string, spec *api.ContainerSpec, vars map[string]string) (string, error) {
+	canonical := &canonicalSpec{Name: spec.Name, Image: spec.Image, Command: spec.Command, Flags: spec.Flags, Vars: vars}
+	for _, secret := range spec.Secrets {
+		canonical.Secrets = append(canonical.Secrets, canonicalSecret{EnvVar: secret.EnvVar, Name: secret.Name, Ciphertext: secret.Ciphertext, Provider: secret.Provider})
+		if secret.Provider != "sops" {
+			continue
+		}
+		path, _, _ := strings.Cut(strings.TrimSpace(secret.Ciphertext), "#")
+		buf, err := os.ReadFile(filepath.Join(dir, filepath.Clean("/"+path)))
+		if err != nil {
+			return "", fmt.Errorf("reading sops file: %w", err)
+		}
+		sum := sha256.Sum256(buf)
+		if canonical.Refs == nil {
+			canonical.Refs = map[string]string{}
+		}
+		canonical.Refs[path] = hex.EncodeToString(sum[:])
+	}
+	for _, file := range spec.Files {
+		canonical.Files = append(canonical.Files, canonicalFile{Path: file.Path, Content: file.Content, Template: file.Template})
+	}
+
+	// JSON is used since it sorts map keys
+	buf, err := json.Marshal(canonical)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return HashVersion + "-" + hex.EncodeToString(sum[:]), nil
+}
+
+// foldLegacyHash folds values that affect the container into its legacy (unversioned) hash: the first of its previous hashes.
+func foldLegacyHash(spec *api.ContainerSpec, values map[string]string) {
+	if len(spec.PreviousHashes) > 0 {
+		spec.PreviousHashes[0] = FoldHash(spec.PreviousHashes[0], values)
+	}
+}
+
+func HasTemplates(spec *api.ContainerSpec) bool {
+	for _, file := range spec.Files {
+		if file.Template {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveSharedSecrets copies the ciphertext of shared secrets declared in cluster.toml
+// into the container secrets that reference them by name.
+func ResolveSharedSecrets(spec *api.ContainerSpec, cluster *ClusterSpec) error {
+	refs := map[string]string{}
+	for _, secret := range spec.Secrets {
+		if secret.Name == "" {
+			continue
+		}
+
+		shared := cluster.FindSecret(secret.Name)
+		if shared == nil {
+			return fmt.Errorf("shared secret %q is not declared in cluster.toml", secret.Name)
+		}
+		secret.Ciphertext = shared.Ciphertext
+		secret.Provider = shared.Provider
+		refs[secret.Name] = shared.Provider + ":" + shared.Ciphertext
+	}
+
+	// Rotating a shared secret should recreate every container that references it.
+	// This is covered by SpecHash since the ciphertext is copied into the spec, but the legacy hash needs to be folded.
+	if len(refs) > 0 {
+		foldLegacyHash(spec, refs)
+	}
+	return nil
+}
+
+// FoldHash mixes the given values into a container hash.
+// This is useful for values that affect the container but don't live in its file.
+func FoldHash(hash string, values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := md5.New()
+	io.WriteString(h, hash)
+	for _, key := range keys {
+		fmt.Fprintf(h, "\n%q=%q", key, values[key])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type ClusterSpec struct {
+	Vars       map[string]string `toml:"vars"`
+	Secrets    []*SharedSecret   `toml:"secret"`
+	Registries []*api.Registry   `toml:"registry"`
+	Nodes      []*NodeSpec       `toml:"node"`
+	Clients    []*ClientSpec     `toml:"client"`
+}
+
+func (c *ClusterSpec) FindSecret(name string) *SharedSecret {
+	for _, secret := range c.Secrets {
+		if secret.Name == name {
+			return secret
+		}
+	}
+	return nil
+}
+
+func (c *ClusterSpec) FindRegistry(hostname string) *api.Registry {
+	for _, registry := range c.Registries {
+		if registry.Hostname == hostname {
+			return registry
+		}
+	}
+	return nil
+}
+
+// FindNode returns the node with the given name or any of the given fingerprints.
+func (c *ClusterSpec) FindNode(id string) *NodeSpec {
+	for _, node := range c.Nodes {
+		if node.Name == id {
+			return node
+		}
+		for _, fingerprint := range node.AllFingerprints() {
+			if fingerprint == id {
+				return node
+			}
+		}
+	}
+	return nil
+}
+
+// SharedSecret is a named ciphertext that can be referenced by any number of containers.
+type SharedSecret struct {
+	Name       string `toml:"name"`
+	Ciphertext string `toml:"ciphertext"`
+	Provider   string `toml:"provider"`
+}
+
+type NodeSpec struct {
+	Name         string   `toml:"name"` // matched against the subject of CA-issued certs
+	Fingerprint  string   `toml:"fingerprint"`
+	Fingerprints []string `toml:"fingerprints"` // additional fingerprints i.e. while rotating certs
+	Containers   []string `toml:"containers"`
+}
+
+// ID returns a human-readable identifier for the node.
+func (n *NodeSpec) ID() string {
+	if n.Name != "" {
+		return n.Name
+	}
+	return n.AllFingerprints()[0]
+}
+
+func (n *NodeSpec) AllFingerprints() []string {
+	return allFingerprints(n.Fingerprint, n.Fingerprints)
+}
+
+type ClientSpec struct {
+	Name         string   `toml:"name"`
+	Fingerprint  string   `toml:"fingerprint"`
+	Fingerprints []string `toml:"fingerprints"`
+	Role         string   `toml:"role"`       // viewer, operator (default), or admin
+	Containers   []string `toml:"containers"` // optional scope - container names
+	Nodes        []string `toml:"nodes"`      // optional scope - node names or fingerprints
+}
+
+// ID returns a human-readable identifier for the client.
+func (c *ClientSpec) ID() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if fps := c.AllFingerprints(); len(fps) > 0 {
+		return fps[0]
+	}
+	return ""
+}
+
+func (c *ClientSpec) AllFingerprints() []string {
+	return allFingerprints(c.Fingerprint, c.Fingerprints)
+}
+
+func allFingerprints(primary string, additional []string) []string {
+	all := []string{}
+	if primary != "" {
+		all = append(all, primary)
+	}
+	for _, fingerprint := range additional {
+		if fingerprint != "" {
+			all = append(all, fingerprint)
+		}
+	}
+	return all
+}
+
+// ContentHash returns a version string for inventories that aren't read from git.
+// It changes whenever any of the node's containers (or vars, or registry credentials) change.
+func ContentHash(inv *api.NodeInventory) string {
+	values := map[string]string{}
+	for key, val := range inv.Vars {
+		values["vars."+key] = val
+	}
+	for _, container := range inv.Containers {
+		values["containers."+container.Name] = container.Hash
+	}
+	for _, registry := range inv.Registries {
+		values["registries."+registry.Hostname] = registry.Provider + ":" + registry.Username + ":" + registry.Password
+	}
+	return FoldHash("", values)
+}
@@ -0,0 +1,202 @@
+package inventory
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jveski/recompose/internal/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "nginx.toml"), []byte(`image = "nginx"`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.toml"), []byte(`image = `), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte(`hi`), 0644))
+
+	inv, err := ReadDir(dir, "test-version")
+	require.NoError(t, err)
+	require.Len(t, inv.Containers, 1)
+	assert.Equal(t, "nginx", inv.Containers[0].Name)
+	assert.Equal(t, "nginx", inv.Containers[0].Image)
+	assert.Equal(t, "test-version", inv.GitSHA)
+
+	// The content hash changes with the containers
+	before := ContentHash(inv)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "nginx.toml"), []byte(`image = "nginx:latest"`), 0644))
+	inv, err = ReadDir(dir, "")
+	require.NoError(t, err)
+	assert.NotEqual(t, before, ContentHash(inv))
+}
+
+func TestFindRegistries(t *testing.T) {
+	cluster := &ClusterSpec{Registries: []*api.Registry{{Hostname: "ghcr.io", Username: "user", Password: "pass"}, {Hostname: "docker.io"}}}
+	containers := []*api.ContainerSpec{{Image: "ghcr.io/org/a:v1"}, {Image: "ghcr.io/org/b:v1"}, {Image: "quay.io/org/c"}}
+
+	registries := findRegistries(cluster, containers)
+	require.Len(t, registries, 1)
+	assert.Equal(t, "ghcr.io", registries[0].Hostname)
+
+	// Rotating credentials changes the content hash
+	inv := &api.NodeInventory{Containers: containers, Registries: registries}
+	before := ContentHash(inv)
+	inv.Registries = []*api.Registry{{Hostname: "ghcr.io", Username: "user", Password: "rotated"}}
+	assert.NotEqual(t, before, ContentHash(inv))
+}
+
+func TestFoldHash(t *testing.T) {
+	a := FoldHash("test-hash", map[string]string{"foo": "bar", "baz": "qux"})
+	b := FoldHash("test-hash", map[string]string{"baz": "qux", "foo": "bar"})
+	assert.Equal(t, a, b)
+
+	c := FoldHash("test-hash", map[string]string{"foo": "bar", "baz": "changed"})
+	assert.NotEqual(t, a, c)
+	assert.NotEqual(t, "test-hash", FoldHash("test-hash", nil))
+}
+
+func TestSpecHash(t *testing.T) {
+	dir := t.TempDir()
+	write := func(file, content string) *api.ContainerSpec {
+		t.Helper()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, file), []byte(content), 0644))
+		spec, err := ReadContainerSpec(filepath.Join(dir, file))
+		require.NoError(t, err)
+		spec.Hash, err = SpecHash(dir, spec, nil)
+		require.NoError(t, err)
+		return spec
+	}
+
+	a := write("test.toml", "image = 'nginx'\nflags = { b = 1, a = 'x' }")
+	assert.True(t, strings.HasPrefix(a.Hash, HashVersion+"-"))
+
+	// Comments and formatting don't matter
+	b := write("test.toml", "# comment\nimage = \"nginx\"\n\n[flags]\na = 'x'\nb = 1\n")
+	assert.Equal(t, a.Hash, b.Hash)
+	assert.NotEqual(t, a.PreviousHashes, b.PreviousHashes)
+
+	c := write("test.toml", "image = 'nginx:latest'\nflags = { b = 1, a = 'x' }")
+	assert.NotEqual(t, a.Hash, c.Hash)
+
+	// Vars are included when given
+	withVars, err := SpecHash(dir, a, map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	assert.NotEqual(t, a.Hash, withVars)
+
+	// The content of referenced sops files is included
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secrets.yaml"), []byte("v1"), 0644))
+	d := write("test.toml", "image = 'nginx'\n[[secret]]\nenvvar = 'FOO'\nprovider = 'sops'\nciphertext = 'secrets.yaml#foo'")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secrets.yaml"), []byte("v2"), 0644))
+	e := write("test.toml", "image = 'nginx'\n[[secret]]\nenvvar = 'FOO'\nprovider = 'sops'\nciphertext = 'secrets.yaml#foo'")
+	assert.NotEqual(t, d.Hash, e.Hash)
+}
+
+// TestSpecHashStable fails when the hash of an existing spec changes, which would recreate every container.
+// Bump HashVersion (and keep the previous hash in PreviousHashes) when that's intended.
+func TestSpecHashStable(t *testing.T) {
+	spec := &api.ContainerSpec{
+		Name:    "test",
+		Image:   "nginx",
+		Command: []string{"nginx", "-g", "daemon off;"},
+		Flags:   map[string]any{"memory": "1g", "publish": []any{"80:80"}},
+		Secrets: []*api.Secret{{EnvVar: "FOO", Ciphertext: "test-ciphertext"}},
+		Files:   []*api.File{{Path: "/etc/test.conf", Content: "test"}},
+	}
+	hash, err := SpecHash(t.TempDir(), spec, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "v2-8b5f03022b69123882ad6693fa3e7f10494ff1ab6cc288bfd50d78a2d480aa5e", hash)
+
+	// Fields that don't affect the container are ignored, as are empty fields
+	spec = &api.ContainerSpec{Name: "test", Image: "nginx"}
+	hash, err = SpecHash(t.TempDir(), spec, nil)
+	require.NoError(t, err)
+	spec.UpdateStrategy = "start-first"
+	spec.ImagePolicy = "track"
+	spec.PreviousHashes = []string{"legacy"}
+	spec.Command = []string{}
+	spec.Flags = map[string]any{}
+	withFields, err := SpecHash(t.TempDir(), spec, nil)
+	require.NoError(t, err)
+	assert.Equal(t, hash, withFields)
+}
+
+// TestSpecHashFields makes sure every field of the container spec is either hashed or deliberately ignored,
+// so new fields can't silently change the hash (or silently not affect it).
+func TestSpecHashFields(t *testing.T) {
+	hashed := map[string]bool{"Name": true, "Image": true, "Command": true, "Flags": true, "Secrets": true, "Files": true}
+	ignored := map[string]bool{"Hash": true, "UpdateStrategy": true, "ImagePolicy": true, "ImageDigest": true, "PreviousHashes": true}
+
+	typ := reflect.TypeOf(api.ContainerSpec{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Name
+		assert.True(t, hashed[name] || ignored[name], "field %s of api.ContainerSpec must be added to canonicalSpec (with omitempty) or ignored by SpecHash", name)
+	}
+}
+
+func TestValidateUpdateStrategy(t *testing.T) {
+	tests := []struct {
+		Name, Strategy string
+		Flags          map[string]any
+		Err            string
+	}{
+		{Name: "default"},
+		{Name: "start-first", Strategy: "start-first", Flags: map[string]any{"publish": []any{"80", "127.0.0.1::443"}}},
+		{Name: "unknown", Strategy: "nope", Err: `unknown update_strategy "nope"`},
+		{Name: "fixed port", Strategy: "start-first", Flags: map[string]any{"p": "8080:80"}, Err: `update_strategy "start-first" can't be used with fixed host ports (8080:80)`},
+		{Name: "host network", Strategy: "start-first", Flags: map[string]any{"network": "host"}, Err: `update_strategy "start-first" can't be used with host networking`},
+		{Name: "stop-first fixed port", Strategy: "stop-first", Flags: map[string]any{"p": "8080:80"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := validateUpdateStrategy(&api.ContainerSpec{UpdateStrategy: tc.Strategy, Flags: tc.Flags})
+			if tc.Err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.Err)
+			}
+		})
+	}
+}
+
+func TestReadContainerSpecInvalidPolicies(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nginx.toml")
+	require.NoError(t, os.WriteFile(file, []byte("image = 'nginx'\nupdate_strategy = 'start-first'\nimage_policy = 'nope'\nflags = { p = '8080:80' }\n"), 0644))
+
+	// The container is kept using the default policies
+	spec, err := ReadContainerSpec(file)
+	require.NoError(t, err)
+	assert.Equal(t, "nginx", spec.Name)
+	assert.Equal(t, "", spec.UpdateStrategy)
+	assert.Equal(t, "", spec.ImagePolicy)
+}
+
+func TestResolveSharedSecrets(t *testing.T) {
+	cluster := &ClusterSpec{Secrets: []*SharedSecret{{Name: "db-password", Ciphertext: "test-ciphertext"}}}
+
+	t.Run("happy path", func(t *testing.T) {
+		spec := &api.ContainerSpec{PreviousHashes: []string{"test-hash"}, Secrets: []*api.Secret{{EnvVar: "DB_PASSWORD", Name: "db-password"}}}
+		require.NoError(t, ResolveSharedSecrets(spec, cluster))
+		assert.Equal(t, "test-ciphertext", spec.Secrets[0].Ciphertext)
+		assert.NotEqual(t, "test-hash", spec.PreviousHashes[0])
+
+		// Rotating the shared ciphertext changes the hash
+		rotated := &ClusterSpec{Secrets: []*SharedSecret{{Name: "db-password", Ciphertext: "new-ciphertext"}}}
+		spec2 := &api.ContainerSpec{PreviousHashes: []string{"test-hash"}, Secrets: []*api.Secret{{EnvVar: "DB_PASSWORD", Name: "db-password"}}}
+		require.NoError(t, ResolveSharedSecrets(spec2, rotated))
+		assert.NotEqual(t, spec.PreviousHashes, spec2.PreviousHashes)
+	})
+
+	t.Run("no references", func(t *testing.T) {
+		spec := &api.ContainerSpec{PreviousHashes: []string{"test-hash"}, Secrets: []*api.Secret{{EnvVar: "FOO", Ciphertext: "inline"}}}
+		require.NoError(t, ResolveSharedSecrets(spec, cluster))
+		assert.Equal(t, []string{"test-hash"}, spec.PreviousHashes)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		spec := &api.ContainerSpec{Secrets: []*api.Secret{{EnvVar: "FOO", Name: "nope"}}}
+		assert.EqualError(t, ResolveSharedSecrets(spec, cluster), `shared secret "nope" is not declared in cluster.toml`)
+	})
+}
@@ -0,0 +1,333 @@
+package rpc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CertificateAuthorizer is optionally implemented by Authorizers that need the peer's full certificate chain
+// rather than only the fingerprint of its leaf certificate.
+type CertificateAuthorizer interface {
+	// TrustsCertificate returns the peer's name when its certificate chain is trusted.
+	TrustsCertificate(chain []*x509.Certificate) (name string, ok bool)
+}
+
+// CAAuthorizer trusts certificates issued by the given CA(s) that haven't expired or been revoked.
+// The peer's identity is taken from the first DNS SAN of its certificate, or the CN when no SANs are present.
+type CAAuthorizer struct {
+	Roots *x509.CertPool
+
+	// Names optionally restricts the trusted names. All names issued by the CA are trusted when nil.
+	Names func(name string) bool
+
+	// CRLFile is an optional PEM or DER encoded certificate revocation list.
+	// It's reloaded when modified.
+	CRLFile string
+
+	lock       sync.Mutex
+	crl        *x509.RevocationList
+	crlModTime time.Time
+}
+
+// LoadCAAuthorizer reads a PEM-encoded CA bundle from disk.
+func LoadCAAuthorizer(caFile, crlFile string) (*CAAuthorizer, error) {
+	buf, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no certificates found in %q", caFile)
+	}
+
+	a := &CAAuthorizer{Roots: roots, CRLFile: crlFile}
+	if crlFile != "" {
+		if _, err := a.loadCRL(); err != nil {
+			return nil, fmt.Errorf("loading CRL: %w", err)
+		}
+	}
+	return a, nil
+}
+
+func (c *CAAuthorizer) TrustsCert(fingerprint string) bool { return false }
+
+func (c *CAAuthorizer) TrustsCertificate(chain []*x509.Certificate) (string, bool) {
+	name, err := c.Verify(chain)
+	return name, err == nil
+}
+
+// Verify returns the name of the peer if its certificate chain is trusted.
+func (c *CAAuthorizer) Verify(chain []*x509.Certificate) (string, error) {
+	if len(chain) == 0 {
+		return "", errors.New("no certificates were presented")
+	}
+	leaf := chain[0]
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	// Expiration is checked by x509
+	verified, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         c.Roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if c.CRLFile != "" {
+		crl, err := c.loadCRL()
+		if err != nil {
+			return "", fmt.Errorf("loading CRL: %w", err)
+		}
+		if err := checkRevocation(crl, verified[0]); err != nil {
+			return "", err
+		}
+	}
+
+	name := GetCertName(leaf)
+	if c.Names != nil && !c.Names(name) {
+		return "", fmt.Errorf("certificate name %q is not trusted", name)
+	}
+	return name, nil
+}
+
+func (c *CAAuthorizer) loadCRL() (*x509.RevocationList, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	info, err := os.Stat(c.CRLFile)
+	if err != nil {
+		return nil, err
+	}
+	if c.crl != nil && info.ModTime().Equal(c.crlModTime) {
+		return c.crl, nil
+	}
+
+	buf, err := os.ReadFile(c.CRLFile)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(buf); block != nil {
+		buf = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(buf)
+	if err != nil {
+		return nil, err
+	}
+	c.crl = crl
+	c.crlModTime = info.ModTime()
+	return crl, nil
+}
+
+// checkRevocation fails closed when the CRL is stale or wasn't issued by the leaf's issuer.
+func checkRevocation(crl *x509.RevocationList, chain []*x509.Certificate) error {
+	if len(chain) < 2 {
+		return errors.New("certificate chain has no issuer")
+	}
+	if err := crl.CheckSignatureFrom(chain[1]); err != nil {
+		return fmt.Errorf("CRL was not issued by the certificate's issuer: %w", err)
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		return errors.New("CRL is out of date")
+	}
+
+	for _, revoked := range crl.RevokedCertificates {
+		if revoked.SerialNumber.Cmp(chain[0].SerialNumber) == 0 {
+			return errors.New("certificate has been revoked")
+		}
+	}
+	return nil
+}
+
+// GenCA generates a CA cert and private key or loads them from disk.
+func GenCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	dir = filepath.Join(dir, "ca")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		certFile = filepath.Join(dir, "ca.pem")
+		keyFile  = filepath.Join(dir, "ca-private-key.pem")
+	)
+
+	certPem, err := os.ReadFile(certFile)
+	if os.IsNotExist(err) {
+		if err := genCA(certFile, keyFile); err != nil {
+			return nil, nil, err
+		}
+		certPem, err = os.ReadFile(certFile)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPem, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPem)
+	keyBlock, _ := pem.Decode(keyPem)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("invalid CA cert or key")
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func genCA(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "recompose internal CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 3650),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return fmt.Errorf("writing key: %w", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("writing cert: %w", err)
+	}
+	return nil
+}
+
+// IssueCertificate signs a client certificate for the given public key using the CA.
+// The returned certificate is PEM-encoded.
+func IssueCertificate(ca *x509.Certificate, caKey crypto.Signer, pub crypto.PublicKey, subject pkix.Name, ttl time.Duration) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Minute), // tolerate some clock skew
+		NotAfter:     time.Now().Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, pub, caKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// TrustAny trusts peers that are trusted by any of the given authorizers.
+func TrustAny(auths ...Authorizer) Authorizer { return anyAuthorizer(auths) }
+
+type anyAuthorizer []Authorizer
+
+func (a anyAuthorizer) TrustsCert(fingerprint string) bool {
+	for _, auth := range a {
+		if auth.TrustsCert(fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a anyAuthorizer) TrustsCertificate(chain []*x509.Certificate) (string, bool) {
+	for _, auth := range a {
+		if ca, ok := auth.(CertificateAuthorizer); ok {
+			if name, ok := ca.TrustsCertificate(chain); ok {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// TrustNames returns a function that matches any of the given names, for use with CAAuthorizer.
+func TrustNames(names ...string) func(string) bool {
+	return func(name string) bool {
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// GetCertName returns the identity of a certificate: its first DNS SAN, or the CN when no SANs are present.
+func GetCertName(cert *x509.Certificate) string {
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// LoadCertificate loads a certificate and private key from disk i.e. one issued by a CA.
+func LoadCertificate(certFile, keyFile string) (tls.Certificate, string /* fingerprint */, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return cert, "", err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, "", err
+	}
+	return cert, GetCertFingerprint(cert.Leaf.Raw), nil
+}
+
+// Authorize checks the peer certificate chain against the authorizer.
+// The peer's name is returned when trusted by a CertificateAuthorizer.
+func Authorize(auth Authorizer, chain []*x509.Certificate) (string, bool) {
+	if auth == nil || len(chain) == 0 {
+		return "", false
+	}
+	if ca, ok := auth.(CertificateAuthorizer); ok {
+		if name, ok := ca.TrustsCertificate(chain); ok {
+			return name, true
+		}
+	}
+	return "", auth.TrustsCert(GetCertFingerprint(chain[0].Raw))
+}
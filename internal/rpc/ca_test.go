@@ -0,0 +1,146 @@
+package rpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCAAuthorizer(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := genTestCA(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644))
+
+	var (
+		valid   = genTestLeaf(t, ca, caKey, 1, "node-1", time.Hour)
+		expired = genTestLeaf(t, ca, caKey, 2, "node-2", -time.Hour)
+		revoked = genTestLeaf(t, ca, caKey, 3, "node-3", time.Hour)
+	)
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(1),
+		ThisUpdate:          time.Now().Add(-time.Minute),
+		NextUpdate:          time.Now().Add(time.Hour),
+		RevokedCertificates: []pkix.RevokedCertificate{{SerialNumber: revoked.SerialNumber, RevocationTime: time.Now()}},
+	}, ca, caKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "crl.pem"), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0644))
+
+	auth, err := LoadCAAuthorizer(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "crl.pem"))
+	require.NoError(t, err)
+
+	t.Run("valid", func(t *testing.T) {
+		name, ok := auth.TrustsCertificate([]*x509.Certificate{valid})
+		assert.True(t, ok)
+		assert.Equal(t, "node-1", name)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		_, ok := auth.TrustsCertificate([]*x509.Certificate{expired})
+		assert.False(t, ok)
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		_, err := auth.Verify([]*x509.Certificate{revoked})
+		assert.EqualError(t, err, "certificate has been revoked")
+	})
+
+	t.Run("self-signed", func(t *testing.T) {
+		other, _ := genTestCA(t)
+		_, ok := auth.TrustsCertificate([]*x509.Certificate{other})
+		assert.False(t, ok)
+	})
+
+	t.Run("name restriction", func(t *testing.T) {
+		restricted := &CAAuthorizer{Roots: auth.Roots, Names: TrustNames("node-2")}
+		_, err := restricted.Verify([]*x509.Certificate{valid})
+		assert.EqualError(t, err, `certificate name "node-1" is not trusted`)
+	})
+
+	t.Run("fingerprints are not trusted", func(t *testing.T) {
+		assert.False(t, auth.TrustsCert(GetCertFingerprint(valid.Raw)))
+	})
+
+	t.Run("middleware", func(t *testing.T) {
+		var q url.Values
+		fn := WithAuth(auth, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) { q = r.URL.Query() })
+
+		r := httptest.NewRequest("GET", "https://test/?name=spoofed", nil)
+		r.TLS.PeerCertificates = []*x509.Certificate{valid}
+		w := httptest.NewRecorder()
+		fn(w, r, nil)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "node-1", q.Get("name"))
+		assert.Equal(t, GetCertFingerprint(valid.Raw), q.Get("fingerprint"))
+
+		r = httptest.NewRequest("GET", "https://test/", nil)
+		r.TLS.PeerCertificates = []*x509.Certificate{expired}
+		w = httptest.NewRecorder()
+		fn(w, r, nil)
+		assert.Equal(t, 403, w.Code)
+	})
+
+	t.Run("any", func(t *testing.T) {
+		combined := TrustAny(TrustOneCert("foo"), auth)
+		assert.True(t, combined.TrustsCert("foo"))
+		_, ok := combined.(CertificateAuthorizer).TrustsCertificate([]*x509.Certificate{valid})
+		assert.True(t, ok)
+	})
+}
+
+func genTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func genTestLeaf(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial int64, name string, ttl time.Duration) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	notAfter := time.Now().Add(ttl)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notAfter.Add(-time.Hour * 2),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
@@ -51,6 +51,20 @@ func TestIntegration(t *testing.T) {
 			AuthorizeClient: AuthorizerFunc(func(fingerprint string) bool { return false }),
 			AuthorizeServer: TrustOneCert(svrFprint),
 		},
+		{
+			Name: "forbidden",
+			Fn: func(t *testing.T, cli *Client, addr string) {
+				e := &ErrUntrustedClient{}
+				_, err := cli.GET(ctx, "https://"+addr)
+				require.ErrorAs(t, err, &e)
+				assert.Equal(t, "this operation requires the admin role", e.Reason)
+			},
+			Handler: func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+				http.Error(w, "this operation requires the admin role", 403)
+			},
+			AuthorizeClient: TrustOneCert(cliFprint),
+			AuthorizeServer: TrustOneCert(svrFprint),
+		},
 		{
 			Name: "untrusted server",
 			Fn: func(t *testing.T, cli *Client, addr string) {
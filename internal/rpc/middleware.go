@@ -1,7 +1,10 @@
 package rpc
 
 import (
+	"bufio"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -19,18 +22,36 @@ func TrustOneCert(finger string) Authorizer {
 	return AuthorizerFunc(func(fingerprint string) bool { return fingerprint == finger })
 }
 
+// TrustCerts trusts any of the given fingerprints, which is useful while rotating certs.
+func TrustCerts(fingers ...string) Authorizer {
+	return AuthorizerFunc(func(fingerprint string) bool {
+		for _, finger := range fingers {
+			if fingerprint == finger {
+				return true
+			}
+		}
+		return false
+	})
+}
+
 func WithAuth(auth Authorizer, next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		fingerprint := GetCertFingerprint(r.TLS.PeerCertificates[0].Raw)
 
-		if auth == nil || !auth.TrustsCert(fingerprint) {
+		name, ok := Authorize(auth, r.TLS.PeerCertificates)
+		if !ok {
 			w.WriteHeader(403)
 			return
 		}
 
-		// This is a hack to pass the fingerprint to handlers because I don't feel like using context values
+		// This is a hack to pass the fingerprint to handlers because I don't feel like using context values.
+		// The name is only set for peers trusted by their CA-issued certificate.
 		q := r.URL.Query()
 		q.Set("fingerprint", fingerprint)
+		q.Del("name")
+		if name != "" {
+			q.Set("name", name)
+		}
 		r.URL.RawQuery = q.Encode()
 
 		next(w, r, ps)
@@ -55,3 +76,13 @@ func (r *responseProxy) WriteHeader(status int) {
 	r.Status = status
 	r.ResponseWriter.WriteHeader(status)
 }
+
+// Hijack allows handlers to take over the connection i.e. to upgrade it to a tunnel.
+func (r *responseProxy) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	r.Status = 101
+	return hj.Hijack()
+}
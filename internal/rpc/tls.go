@@ -86,6 +86,42 @@ func GenCertificate(dir string) (tls.Certificate, string /* fingerprint */, erro
 	return certObj, fingerprint, err
 }
 
+// GenNextCertificate generates (or loads) the certificate that will replace the one in dir once promoted.
+// Its fingerprint can be trusted alongside the current one to rotate certs without downtime.
+func GenNextCertificate(dir string) (tls.Certificate, string /* fingerprint */, error) {
+	return GenCertificate(filepath.Join(dir, "next"))
+}
+
+// HasNextCertificate returns true when a rotation has been started by GenNextCertificate.
+func HasNextCertificate(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "next", "tls", "cert.pem"))
+	return err == nil
+}
+
+// PromoteNextCertificate replaces the current certificate with the one generated by GenNextCertificate.
+// The previous certificate is retained in the "prev" directory.
+func PromoteNextCertificate(dir string) error {
+	var (
+		current = filepath.Join(dir, "tls")
+		next    = filepath.Join(dir, "next")
+		prev    = filepath.Join(dir, "prev")
+	)
+
+	if err := os.RemoveAll(prev); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(prev, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(current, filepath.Join(prev, "tls")); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(next, "tls"), current); err != nil {
+		return err
+	}
+	return os.RemoveAll(next)
+}
+
 func genCert() ([]byte, []byte, error) {
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -33,3 +33,27 @@ func TestGenCertificate(t *testing.T) {
 	assert.Equal(t, initialFingerprint, fingerprint)
 	assert.Equal(t, initialFingerprint, GetCertFingerprint(cert.Leaf.Raw))
 }
+
+func TestRotateCertificate(t *testing.T) {
+	dir := t.TempDir()
+
+	_, currentFingerprint, err := GenCertificate(dir)
+	require.NoError(t, err)
+	assert.False(t, HasNextCertificate(dir))
+
+	_, nextFingerprint, err := GenNextCertificate(dir)
+	require.NoError(t, err)
+	assert.True(t, HasNextCertificate(dir))
+	assert.NotEqual(t, currentFingerprint, nextFingerprint)
+
+	require.NoError(t, PromoteNextCertificate(dir))
+	assert.False(t, HasNextCertificate(dir))
+
+	_, fingerprint, err := GenCertificate(dir)
+	require.NoError(t, err)
+	assert.Equal(t, nextFingerprint, fingerprint)
+
+	_, prevFingerprint, err := GenCertificate(filepath.Join(dir, "prev"))
+	require.NoError(t, err)
+	assert.Equal(t, currentFingerprint, prevFingerprint)
+}
@@ -34,7 +34,7 @@ func NewClient(cert tls.Certificate, timeout time.Duration, auth Authorizer) *Cl
 			Transport: &http.Transport{
 				TLSHandshakeTimeout: time.Second * 15,
 				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true, // this is safe because we verify the fingerprint in VerifyPeerCertificate
+					InsecureSkipVerify: true, // this is safe because we verify the fingerprint (or CA chain) in VerifyPeerCertificate
 					Certificates:       []tls.Certificate{cert},
 					VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 						for _, cert := range rawCerts {
@@ -43,6 +43,20 @@ func NewClient(cert tls.Certificate, timeout time.Duration, auth Authorizer) *Cl
 							}
 						}
 
+						if ca, ok := auth.(CertificateAuthorizer); ok {
+							chain := make([]*x509.Certificate, len(rawCerts))
+							for i, raw := range rawCerts {
+								cert, err := x509.ParseCertificate(raw)
+								if err != nil {
+									return err
+								}
+								chain[i] = cert
+							}
+							if _, ok := ca.TrustsCertificate(chain); ok {
+								return nil
+							}
+						}
+
 						return &ErrUntrustedServer{Fingerprint: GetCertFingerprint(rawCerts[0])}
 					},
 				},
@@ -64,7 +78,11 @@ func (c *Client) do(ctx context.Context, method, url string, body io.Reader) (*h
 	if err != nil {
 		return nil, err
 	}
+	return c.Send(req)
+}
 
+// Send is like http.Client.Do but returns errors for unsuccessful status codes, like the GET and POST helpers.
+func (c *Client) Send(req *http.Request) (*http.Response, error) {
 	resp, err := c.Client.Do(req)
 	if err != nil {
 		return nil, err
@@ -72,8 +90,9 @@ func (c *Client) do(ctx context.Context, method, url string, body io.Reader) (*h
 
 	if resp.StatusCode == 403 {
 		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
 		t := c.Transport.(*http.Transport)
-		return nil, &ErrUntrustedClient{Fingerprint: GetCertFingerprint(t.TLSClientConfig.Certificates[0].Leaf.Raw)}
+		return nil, &ErrUntrustedClient{Fingerprint: GetCertFingerprint(t.TLSClientConfig.Certificates[0].Leaf.Raw), Reason: strings.TrimSpace(string(body))}
 	}
 	if resp.StatusCode >= 300 {
 		defer resp.Body.Close()
@@ -104,6 +123,12 @@ func (e *ErrUntrustedServer) Error() string { return "untrusted server certifica
 
 type ErrUntrustedClient struct {
 	Fingerprint string
+	Reason      string // set when the client is trusted, but isn't allowed to perform the operation i.e. lacks a role
 }
 
-func (e *ErrUntrustedClient) Error() string { return "server does not trust this client" }
+func (e *ErrUntrustedClient) Error() string {
+	if e.Reason != "" {
+		return "server denied the request: " + e.Reason
+	}
+	return "server does not trust this client"
+}
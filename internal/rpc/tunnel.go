@@ -0,0 +1,195 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// TunnelProtocol is the HTTP upgrade protocol used to reverse the roles of a connection:
+// once upgraded, the server sends requests to the client that dialed it.
+// This allows the server to reach peers that don't accept inbound connections.
+const TunnelProtocol = "recompose-tunnel"
+
+const maxIdleTunnelsPerPeer = 8
+
+// DialTunnel opens a connection to the given tunnel endpoint and upgrades it.
+// The caller is expected to serve HTTP over the returned connection.
+func DialTunnel(ctx context.Context, endpoint string, config *tls.Config) (*tls.Conn, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &tls.Dialer{Config: config}
+	c, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*tls.Conn)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", TunnelProtocol)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := readUpgradeResponse(conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode == 403 {
+		conn.Close()
+		return nil, &ErrUntrustedClient{Fingerprint: GetCertFingerprint(config.Certificates[0].Leaf.Raw)}
+	}
+	if resp.StatusCode != 101 {
+		conn.Close()
+		return nil, fmt.Errorf("server error status: %d", resp.StatusCode)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// readUpgradeResponse reads the response one byte at a time to avoid buffering any of the requests that follow it.
+func readUpgradeResponse(conn net.Conn, req *http.Request) (*http.Response, error) {
+	buf := []byte{}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n\r\n")) {
+		if len(buf) > 1<<12 {
+			return nil, errors.New("upgrade response is too large")
+		}
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		buf = append(buf, b[0])
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), req)
+}
+
+// TunnelPool holds the idle tunnels opened by each peer.
+type TunnelPool struct {
+	lock  sync.Mutex
+	conns map[string][]*idleTunnel
+}
+
+type idleTunnel struct {
+	Conn net.Conn
+	Dead bool
+	done chan struct{}
+}
+
+func NewTunnelPool() *TunnelPool {
+	return &TunnelPool{conns: make(map[string][]*idleTunnel)}
+}
+
+// Accept upgrades the request's connection and adds it to the pool of tunnels opened by the given peer.
+func (t *TunnelPool) Accept(key string, w http.ResponseWriter, r *http.Request) error {
+	if r.Header.Get("Upgrade") != TunnelProtocol {
+		return fmt.Errorf("expected upgrade to %q", TunnelProtocol)
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return err
+	}
+	if rw.Reader.Buffered() > 0 {
+		conn.Close()
+		return errors.New("peer sent data before the upgrade completed")
+	}
+
+	conn.SetDeadline(time.Time{})
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", TunnelProtocol)
+	t.put(key, conn)
+	return nil
+}
+
+func (t *TunnelPool) put(key string, conn net.Conn) {
+	tunnel := &idleTunnel{Conn: conn, done: make(chan struct{})}
+
+	t.lock.Lock()
+	if len(t.conns[key]) >= maxIdleTunnelsPerPeer {
+		t.lock.Unlock()
+		conn.Close()
+		return
+	}
+	t.conns[key] = append(t.conns[key], tunnel)
+	t.lock.Unlock()
+
+	// Idle tunnels are read in the background to detect when they're closed by the peer.
+	// Taking a tunnel from the pool interrupts the read using a deadline.
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			tunnel.Dead = true // the peer closed the connection or violated the protocol
+			conn.Close()
+			t.remove(key, tunnel)
+		}
+		close(tunnel.done)
+	}()
+}
+
+func (t *TunnelPool) remove(key string, tunnel *idleTunnel) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i, val := range t.conns[key] {
+		if val == tunnel {
+			t.conns[key] = append(t.conns[key][:i], t.conns[key][i+1:]...)
+			break
+		}
+	}
+	if len(t.conns[key]) == 0 {
+		delete(t.conns, key)
+	}
+}
+
+// Take removes an idle tunnel opened by the given peer from the pool.
+// Returns nil if none are available.
+func (t *TunnelPool) Take(key string) net.Conn {
+	for {
+		t.lock.Lock()
+		tunnels := t.conns[key]
+		if len(tunnels) == 0 {
+			t.lock.Unlock()
+			return nil
+		}
+		tunnel := tunnels[len(tunnels)-1]
+		if len(tunnels) == 1 {
+			delete(t.conns, key)
+		} else {
+			t.conns[key] = tunnels[:len(tunnels)-1]
+		}
+		t.lock.Unlock()
+
+		tunnel.Conn.SetReadDeadline(time.Now())
+		<-tunnel.done
+		if tunnel.Dead {
+			continue
+		}
+		tunnel.Conn.SetReadDeadline(time.Time{})
+		return tunnel.Conn
+	}
+}
@@ -0,0 +1,100 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnel(t *testing.T) {
+	pool := NewTunnelPool()
+	svr := httptest.NewTLSServer(WithLogging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := pool.Accept("test-peer", w, r); err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+	})))
+	defer svr.Close()
+
+	cert, _, err := GenCertificate(t.TempDir())
+	require.NoError(t, err)
+	config := &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}}
+
+	// The peer serves HTTP over the tunnel it dialed
+	conn, err := DialTunnel(context.Background(), svr.URL+"/tunnel", config)
+	require.NoError(t, err)
+	peer := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from the peer"))
+	})}
+	go peer.Serve(&oneConnListener{conn: conn})
+	defer peer.Close()
+
+	// The server sends requests back over the tunnel
+	tunnel := pool.Take("test-peer")
+	require.NotNil(t, tunnel)
+	assert.Nil(t, pool.Take("test-peer"))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) { return tunnel, nil },
+	}}
+	resp, err := client.Get("https://test-peer/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello from the peer", string(body))
+
+	// Tunnels closed by the peer are removed from the pool
+	conn, err = DialTunnel(context.Background(), svr.URL+"/tunnel", config)
+	require.NoError(t, err)
+	conn.Close()
+	assert.Eventually(t, func() bool { return pool.Take("test-peer") == nil }, time.Second, time.Millisecond*10)
+}
+
+func TestTunnelNoUpgrade(t *testing.T) {
+	pool := NewTunnelPool()
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := pool.Accept("test-peer", w, r); err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+	}))
+	defer svr.Close()
+
+	resp, err := svr.Client().Get(svr.URL + "/tunnel")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Nil(t, pool.Take("test-peer"))
+}
+
+type oneConnListener struct {
+	conn net.Conn
+	done chan struct{}
+}
+
+func (o *oneConnListener) Accept() (net.Conn, error) {
+	if o.conn != nil {
+		conn := o.conn
+		o.conn = nil
+		o.done = make(chan struct{})
+		return conn, nil
+	}
+	<-o.done
+	return nil, net.ErrClosed
+}
+
+func (o *oneConnListener) Close() error {
+	if o.done != nil {
+		close(o.done)
+	}
+	return nil
+}
+
+func (o *oneConnListener) Addr() net.Addr { return &net.TCPAddr{} }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jveski/recompose/internal/api"
+	"github.com/urfave/cli/v2"
+)
+
+func historyCmd(c *cli.Context) error {
+	cc, err := setup(c)
+	if err != nil {
+		return err
+	}
+
+	resp, err := cc.Client.GET(c.Context, cc.BaseURL+"/history?limit="+strconv.Itoa(c.Int("limit")))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	history := &api.DeploymentHistory{}
+	if _, err := toml.NewDecoder(resp.Body).Decode(history); err != nil {
+		return err
+	}
+
+	printHistory(history.Deployments, os.Stdout)
+	return nil
+}
+
+func printHistory(deployments []*api.Deployment, w io.Writer) {
+	tr := tabwriter.NewWriter(w, 6, 6, 4, ' ', 0)
+	fmt.Fprintf(tr, "AGE\tVERSION\tTRIGGER\tAUTHOR\tMESSAGE\tCHANGES\n")
+	for i := len(deployments) - 1; i >= 0; i-- {
+		d := deployments[i]
+		version := d.Version
+		if len(version) > 7 {
+			version = version[:7]
+		}
+		message := ""
+		if d.Message != "" {
+			message = fmt.Sprintf("%q", d.Message)
+		}
+		fmt.Fprintf(tr, "%s\t%s\t%s\t%s\t%s\t%s\n", durationToString(time.Since(d.Time)), version, d.Trigger, d.Author, message, formatNodeChanges(d.Nodes))
+	}
+	tr.Flush()
+}
+
+// formatNodeChanges summarizes changes like "node-1: +added ~changed -removed, node-2: ...".
+func formatNodeChanges(changes []*api.NodeChanges) string {
+	nodes := make([]string, len(changes))
+	for i, c := range changes {
+		items := []string{}
+		for _, name := range c.Added {
+			items = append(items, "+"+name)
+		}
+		for _, name := range c.Changed {
+			items = append(items, "~"+name)
+		}
+		for _, name := range c.Removed {
+			items = append(items, "-"+name)
+		}
+		nodes[i] = c.Node + ": " + strings.Join(items, " ")
+	}
+	return strings.Join(nodes, ", ")
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jveski/recompose/internal/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintHistory(t *testing.T) {
+	now := time.Now()
+	deployments := []*api.Deployment{
+		{Version: "1111111111111111", Time: now.Add(-time.Hour * 3), Trigger: "startup", Author: "test <test@test>", Message: "first", Nodes: []*api.NodeChanges{{Node: "node-1", Added: []string{"nginx"}}}},
+		{Version: "2222222222222222", Time: now.Add(-time.Minute * 2), Trigger: "rollback", Nodes: []*api.NodeChanges{
+			{Node: "node-1", Changed: []string{"nginx"}, Removed: []string{"redis"}},
+			{Node: "node-2", Added: []string{"postgres"}},
+		}},
+	}
+
+	buf := &bytes.Buffer{}
+	printHistory(deployments, buf)
+
+	assert.Equal(t, "AGE    VERSION    TRIGGER     AUTHOR              MESSAGE    CHANGES\n2m     2222222    rollback                                   node-1: ~nginx -redis, node-2: +postgres\n3h     1111111    startup     test <test@test>    \"first\"    node-1: +nginx\n", buf.String())
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+func loginCmd(c *cli.Context) error {
+	if c.String("tls-cert") != "" {
+		return errors.New("logging in is not supported when using --tls-cert")
+	}
+
+	cc, err := setupWithLogin(c, false)
+	if err != nil {
+		return err
+	}
+
+	signer, ok := cc.Cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("unsupported private key type")
+	}
+	pub, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	if d := c.Duration("duration"); d > 0 {
+		q.Set("duration", d.String())
+	}
+	if role := c.String("role"); role != "" {
+		q.Set("role", role)
+	}
+	if name := c.String("name"); name != "" {
+		q.Set("user", name)
+	}
+
+	req, err := http.NewRequestWithContext(c.Context, "POST", cc.BaseURL+"/login?"+q.Encode(), bytes.NewReader(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})))
+	if err != nil {
+		return err
+	}
+	if token := c.String("token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := cc.Client.Send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	certPem, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(cc.Dir, "tls", "login-cert.pem"), certPem, 0644); err != nil {
+		return fmt.Errorf("writing login cert: %w", err)
+	}
+
+	cert, err := loadLoginCert(cc.Dir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "logged in as %q until %s\n", cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter.Local().Format(time.RFC1123))
+	return nil
+}
+
+// loadLoginCert loads the cert issued by `rectl login`, which shares the private key of the generated cert.
+func loadLoginCert(dir string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "tls", "login-cert.pem"), filepath.Join(dir, "tls", "cert-private-key.pem"))
+	if err != nil {
+		return cert, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, err
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return cert, errors.New("login cert has expired")
+	}
+	return cert, nil
+}
@@ -57,7 +57,7 @@ func resolveContainerName(cluster [][]string, ref string) (string, string, error
 		}
 		var (
 			containerName   = row[0]
-			nodeFingerprint = row[5]
+			nodeFingerprint = row[len(row)-1]
 		)
 		if containerName != chunks[0] {
 			continue
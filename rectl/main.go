@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"os"
@@ -19,16 +20,35 @@ func main() {
 		Usage: "Recompose admin tools",
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:     "coordinator",
-				Usage:    "Address of the Recompose coordinator i.e. `recompose.mydomain` or `recompose.mydomain:8124`",
-				Required: true,
-				EnvVars:  []string{"RECOMPOSE_COORDINATOR"},
+				Name:    "coordinator",
+				Usage:   "Address of the Recompose coordinator i.e. `recompose.mydomain` or `recompose.mydomain:8124`",
+				EnvVars: []string{"RECOMPOSE_COORDINATOR"},
 			},
 			&cli.DurationFlag{
 				Name:  "timeout",
 				Usage: "Timeout when sending requests to the Recompose coordinator",
 				Value: time.Second * 15,
 			},
+			&cli.StringFlag{
+				Name:    "coordinator-ca",
+				Usage:   "PEM bundle of CAs trusted to issue the coordinator's cert (instead of ~/.rectl/trustedcerts)",
+				EnvVars: []string{"RECOMPOSE_COORDINATOR_CA"},
+			},
+			&cli.StringFlag{
+				Name:    "coordinator-name",
+				Usage:   "Name (DNS SAN or CN) of the coordinator's CA-issued cert",
+				EnvVars: []string{"RECOMPOSE_COORDINATOR_NAME"},
+			},
+			&cli.StringFlag{
+				Name:    "tls-cert",
+				Usage:   "Client cert i.e. one issued by a CA (defaults to a generated self-signed cert)",
+				EnvVars: []string{"RECOMPOSE_TLS_CERT"},
+			},
+			&cli.StringFlag{
+				Name:    "tls-key",
+				Usage:   "Private key of --tls-cert",
+				EnvVars: []string{"RECOMPOSE_TLS_KEY"},
+			},
 		},
 		Commands: []*cli.Command{
 			{
@@ -48,6 +68,164 @@ func main() {
 				},
 				Action: logsCmd,
 			},
+			{
+				Name:  "login",
+				Usage: "Get a short-lived client cert from the coordinator",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "duration",
+						Usage: "How long the cert should be valid (defaults to the coordinator's maximum)",
+					},
+					&cli.StringFlag{
+						Name:  "role",
+						Usage: "Role to embed in the cert",
+					},
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "Name to embed in the cert when logging in with a bootstrap token",
+					},
+					&cli.StringFlag{
+						Name:    "token",
+						Usage:   "Bootstrap token used to log in when this client isn't declared in cluster.toml",
+						EnvVars: []string{"RECOMPOSE_LOGIN_TOKEN"},
+					},
+				},
+				Action: loginCmd,
+			},
+			{
+				Name:  "nodes",
+				Usage: "Manage the nodes that have asked to join the cluster",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "pending",
+						Usage:  "List agents that aren't declared in cluster.toml but have enrolled with the coordinator",
+						Action: nodesPendingCmd,
+					},
+					{
+						Name:      "approve",
+						Usage:     "Print the [[node]] stanza of a pending node, or append it to cluster.toml",
+						ArgsUsage: "<node fingerprint prefix>",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "write",
+								Usage: "Append the stanza to this cluster.toml instead of printing it",
+							},
+						},
+						Action: nodesApproveCmd,
+					},
+				},
+			},
+			{
+				Name:  "render",
+				Usage: "Print the inventory the coordinator would serve to a node, read from a local checkout of the GitOps repo",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "node",
+						Usage:    "Name or fingerprint (prefix) of the node",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "sha",
+						Usage: "Render the repo at this commit instead of the working tree",
+					},
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "Directory containing cluster.toml (defaults to the closest parent directory containing cluster.toml)",
+					},
+				},
+				Action: renderCmd,
+			},
+			{
+				Name:      "diff",
+				Usage:     "List the containers added, removed, or changed on each node between two commits of a local checkout of the GitOps repo",
+				ArgsUsage: "<sha1> <sha2>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "Directory containing cluster.toml (defaults to the closest parent directory containing cluster.toml)",
+					},
+				},
+				Action: diffCmd,
+			},
+			{
+				Name:  "history",
+				Usage: "List the most recent inventory changes deployed by the coordinator, newest first",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "Number of deployments to list",
+						Value: 20,
+					},
+				},
+				Action: historyCmd,
+			},
+			{
+				Name:      "pin",
+				Usage:     "Deploy a particular commit of the GitOps repo until `rectl unpin` is run",
+				ArgsUsage: "<commit SHA>",
+				Action:    pinCmd,
+			},
+			{
+				Name:   "unpin",
+				Usage:  "Resume deploying the latest commit of the GitOps repo",
+				Action: unpinCmd,
+			},
+			{
+				Name:  "rollback",
+				Usage: "Pin the parent of the commit currently being deployed (or the given commit)",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "SHA of the commit to roll back to",
+					},
+				},
+				Action: rollbackCmd,
+			},
+			{
+				Name:  "push",
+				Usage: "Upload the GitOps repo to a coordinator that uses --inventory-source=push",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "key",
+						Usage:    "Path to the SSH private key used to sign the tarball - must be listed in the coordinator's --push-allowed-signers",
+						EnvVars:  []string{"RECOMPOSE_PUSH_KEY"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "Root of the GitOps repo (defaults to the closest parent directory containing cluster.toml)",
+					},
+				},
+				Action: pushCmd,
+			},
+			{
+				Name:  "secret",
+				Usage: "Manage the encrypted secrets in a GitOps repo",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "set",
+						Usage:     "Encrypt a value read from stdin to the cluster's recipients and write it to a container file",
+						ArgsUsage: "<container.toml> <env var>",
+						Action:    secretSetCmd,
+					},
+					{
+						Name:  "rotate-recipients",
+						Usage: "Re-encrypt every secret in the repo to the recipients currently declared in cluster.toml",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "identity",
+								Usage:    "Path to an age identity file able to decrypt the existing secrets",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "dir",
+								Usage: "Root of the GitOps repo (defaults to the closest parent directory containing cluster.toml)",
+							},
+						},
+						Action: secretRotateRecipientsCmd,
+					},
+				},
+			},
 		},
 	}
 
@@ -63,33 +241,70 @@ func main() {
 type appContext struct {
 	Client  *rpc.Client
 	BaseURL string
+	Dir     string
+	Cert    tls.Certificate
 }
 
 func setup(c *cli.Context) (*appContext, error) {
+	return setupWithLogin(c, true)
+}
+
+// setupWithLogin optionally uses the cert issued by `rectl login` when it exists and hasn't expired.
+func setupWithLogin(c *cli.Context, useLogin bool) (*appContext, error) {
+	if c.String("coordinator") == "" {
+		return nil, errors.New("the --coordinator flag or RECOMPOSE_COORDINATOR env var is required")
+	}
+
 	homedir, err := os.UserHomeDir()
 	if err != nil {
 		return nil, fmt.Errorf("getting homedir: %w", err)
 	}
 	dir := filepath.Join(homedir, ".rectl")
 
-	cert, _, err := rpc.GenCertificate(dir)
+	var cert tls.Certificate
+	if c.String("tls-cert") != "" {
+		cert, _, err = rpc.LoadCertificate(c.String("tls-cert"), c.String("tls-key"))
+	} else {
+		cert, _, err = rpc.GenCertificate(dir)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("generating cert: %w", err)
 	}
 
+	if useLogin && c.String("tls-cert") == "" {
+		if login, err := loadLoginCert(dir); err == nil {
+			cert = login
+		}
+	}
+
 	trusted, err := loadTrustedCerts(dir)
 	if err != nil {
 		return nil, fmt.Errorf("reading trusted certs file: %w", err)
 	}
 
-	client := rpc.NewClient(cert, c.Duration("timeout"), rpc.AuthorizerFunc(func(fingerprint string) bool {
+	var auth rpc.Authorizer = rpc.AuthorizerFunc(func(fingerprint string) bool {
 		_, ok := trusted[fingerprint]
 		return ok
-	}))
+	})
+	if caFile := c.String("coordinator-ca"); caFile != "" {
+		if c.String("coordinator-name") == "" {
+			return nil, errors.New("--coordinator-name is required when using --coordinator-ca")
+		}
+		ca, err := rpc.LoadCAAuthorizer(caFile, "")
+		if err != nil {
+			return nil, fmt.Errorf("loading coordinator CA: %w", err)
+		}
+		ca.Names = rpc.TrustNames(c.String("coordinator-name"))
+		auth = rpc.TrustAny(auth, ca)
+	}
+
+	client := rpc.NewClient(cert, c.Duration("timeout"), auth)
 
 	return &appContext{
 		Client:  client,
 		BaseURL: rpc.UrlPrefix(c.String("coordinator")),
+		Dir:     dir,
+		Cert:    cert,
 	}, nil
 }
 
@@ -119,8 +334,11 @@ func getErrorString(err error) string {
 	}
 
 	ec := &rpc.ErrUntrustedClient{}
+	if errors.As(err, &ec) && ec.Reason != "" {
+		return fmt.Sprintf("error: %s\n", ec)
+	}
 	if errors.As(err, &ec) {
-		return fmt.Sprintf("The server does not trust your client certificate.\nAdd its fingerprint to the cluster's `cluster.toml` like this:\n\n[[ client ]]\nfingerprint = \"%s\"\n\n", ec.Fingerprint)
+		return fmt.Sprintf("The server does not trust your client certificate.\nAdd its fingerprint to the cluster's `cluster.toml` like this:\n\n[[ client ]]\nfingerprint = \"%s\"\n\nOr log in using a bootstrap token: rectl login --name <your name> --token <token>\n\n", ec.Fingerprint)
 	}
 
 	return fmt.Sprintf("error: %s\n", err)
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+
+	"github.com/urfave/cli/v2"
+)
+
+func nodesPendingCmd(c *cli.Context) error {
+	cc, err := setup(c)
+	if err != nil {
+		return err
+	}
+
+	pending, err := getPendingNodes(c, cc)
+	if err != nil {
+		return err
+	}
+
+	tr := tabwriter.NewWriter(os.Stdout, 6, 6, 4, ' ', 0)
+	fmt.Fprintf(tr, "FINGERPRINT\tIP\tENROLLED\tFACTS\n")
+	for _, row := range pending {
+		fmt.Fprintf(tr, "%s\t%s\t%s\t%s\n", row[0], row[1], transformTime(row[2]), row[3])
+	}
+	tr.Flush()
+	return nil
+}
+
+func nodesApproveCmd(c *cli.Context) error {
+	prefix := c.Args().First()
+	if prefix == "" {
+		return errors.New("a node fingerprint (or prefix) is required")
+	}
+
+	cc, err := setup(c)
+	if err != nil {
+		return err
+	}
+
+	pending, err := getPendingNodes(c, cc)
+	if err != nil {
+		return err
+	}
+	row, err := resolvePendingNode(pending, prefix)
+	if err != nil {
+		return err
+	}
+	stanza := formatNodeStanza(row)
+
+	file := c.String("write")
+	if file == "" {
+		fmt.Print(stanza)
+		return nil
+	}
+
+	doc, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if len(doc) > 0 && !strings.HasSuffix(string(doc), "\n") {
+		doc = append(doc, '\n')
+	}
+	if err := writeFileAtomic(file, append(append(doc, '\n'), stanza...)); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Added node %s to %s - commit and push it to complete the approval\n", row[0], file)
+	return nil
+}
+
+func getPendingNodes(c *cli.Context, cc *appContext) ([][]string, error) {
+	resp, err := cc.Client.GET(c.Context, cc.BaseURL+"/pending")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	valid := [][]string{}
+	for _, row := range rows {
+		if len(row) >= 4 {
+			valid = append(valid, row)
+		}
+	}
+	return valid, nil
+}
+
+func resolvePendingNode(pending [][]string, prefix string) ([]string, error) {
+	var match []string
+	for _, row := range pending {
+		if !strings.HasPrefix(row[0], prefix) {
+			continue
+		}
+		if match != nil {
+			return nil, fmt.Errorf("fingerprint prefix %q matches more than one pending node", prefix)
+		}
+		match = row
+	}
+	if match == nil {
+		return nil, errors.New("pending node not found")
+	}
+	return match, nil
+}
+
+func formatNodeStanza(row []string) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "[[ node ]]\n")
+	fmt.Fprintf(b, "# ip=%s %s\n", escapeComment(row[1]), escapeComment(row[3]))
+	fmt.Fprintf(b, "fingerprint = %q\n", row[0])
+	fmt.Fprintf(b, "containers = []\n")
+	return b.String()
+}
+
+// escapeComment keeps values reported by the (unauthenticated) agent from breaking out of a TOML comment.
+func escapeComment(str string) string {
+	b := &strings.Builder{}
+	for _, r := range str {
+		if unicode.IsControl(r) {
+			b.WriteString(strings.Trim(strconv.QuoteRune(r), "'"))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolvePendingNode(t *testing.T) {
+	pending := [][]string{
+		{"abc123", "10.0.0.1", "", ""},
+		{"abd456", "10.0.0.2", "", ""},
+	}
+
+	row, err := resolvePendingNode(pending, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", row[1])
+
+	_, err = resolvePendingNode(pending, "ab")
+	assert.EqualError(t, err, `fingerprint prefix "ab" matches more than one pending node`)
+
+	_, err = resolvePendingNode(pending, "nope")
+	assert.EqualError(t, err, "pending node not found")
+}
+
+func TestFormatNodeStanza(t *testing.T) {
+	stanza := formatNodeStanza([]string{"abc123", "10.0.0.1", "", "hostname=node-1 os=linux"})
+	assert.Equal(t, "[[ node ]]\n# ip=10.0.0.1 hostname=node-1 os=linux\nfingerprint = \"abc123\"\ncontainers = []\n", stanza)
+
+	cluster := struct {
+		Nodes []struct {
+			Fingerprint string `toml:"fingerprint"`
+		} `toml:"node"`
+	}{}
+	_, err := toml.Decode(stanza, &cluster)
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", cluster.Nodes[0].Fingerprint)
+
+	// Control characters can't break out of the comment
+	stanza = formatNodeStanza([]string{"abc123", "10.0.0.1\n[[node]]", "", "hostname=node-1\rfingerprint=\"evil\""})
+	assert.Contains(t, stanza, `# ip=10.0.0.1\n[[node]] hostname=node-1\rfingerprint="evil"`+"\n")
+
+	cluster.Nodes = nil
+	_, err = toml.Decode(stanza, &cluster)
+	require.NoError(t, err)
+	require.Len(t, cluster.Nodes, 1)
+	assert.Equal(t, "abc123", cluster.Nodes[0].Fingerprint)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+func pinCmd(c *cli.Context) error {
+	sha := c.Args().First()
+	if sha == "" {
+		return errors.New("a commit SHA is required")
+	}
+	return pin(c, url.Values{"sha": {sha}})
+}
+
+func rollbackCmd(c *cli.Context) error {
+	q := url.Values{"rollback": {"true"}}
+	if to := c.String("to"); to != "" {
+		q.Set("sha", to)
+	}
+	return pin(c, q)
+}
+
+func pin(c *cli.Context, q url.Values) error {
+	cc, err := setup(c)
+	if err != nil {
+		return err
+	}
+
+	resp, err := cc.Client.POST(c.Context, cc.BaseURL+"/pin?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	sha, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "pinned commit %s - run `rectl unpin` to resume deploying the latest commit\n", sha)
+	return nil
+}
+
+func unpinCmd(c *cli.Context) error {
+	cc, err := setup(c)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(c.Context, "DELETE", cc.BaseURL+"/pin", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := cc.Client.Send(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	fmt.Fprintf(os.Stderr, "unpinned - the latest commit will be deployed\n")
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/jveski/recompose/internal/api"
+	"github.com/urfave/cli/v2"
+)
+
+func pushCmd(c *cli.Context) error {
+	dir := c.String("dir")
+	if dir == "" {
+		var err error
+		dir, err = findRepoRoot(".")
+		if err != nil {
+			return err
+		}
+	}
+
+	tarball, err := buildTarball(dir)
+	if err != nil {
+		return fmt.Errorf("building tarball: %w", err)
+	}
+	signature, err := sshSign(c.String("key"), api.PushSignatureNamespace, tarball)
+	if err != nil {
+		return err
+	}
+
+	cc, err := setup(c)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(c.Context, "POST", cc.BaseURL+"/push", bytes.NewReader(tarball))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(api.PushSignatureHeader, base64.StdEncoding.EncodeToString(signature))
+
+	resp, err := cc.Client.Send(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	fmt.Fprintf(os.Stderr, "pushed %s (%d bytes)\n", dir, len(tarball))
+	return nil
+}
+
+// buildTarball returns a gzipped tarball of the regular files in dir, excluding the .git directory.
+func buildTarball(dir string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if path == dir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case d.IsDir():
+			return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: rel + "/", Mode: 0755})
+		case !d.Type().IsRegular():
+			return fmt.Errorf("%s is not a regular file", rel)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: rel, Mode: 0644, Size: int64(len(content))}); err != nil {
+			return err
+		}
+		_, err = tw.Write(content)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sshSign signs the message using `ssh-keygen -Y sign` with the given private key.
+func sshSign(key, namespace string, msg []byte) ([]byte, error) {
+	if key == "" {
+		return nil, errors.New("an ssh key is required to sign the tarball")
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("ssh-keygen", "-Y", "sign", "-f", key, "-n", namespace)
+	cmd.Stdin = bytes.NewReader(msg)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("signing tarball: %s - %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
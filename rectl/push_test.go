@@ -0,0 +1,54 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildTarball(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, ".git"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "apps"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte("test"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cluster.toml"), []byte("[[node]]"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "apps", "test.toml"), []byte("image = 'test'"), 0644))
+
+	tarball, err := buildTarball(dir)
+	require.NoError(t, err)
+
+	gz, err := gzip.NewReader(bytes.NewReader(tarball))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+
+	files := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(content)
+	}
+
+	assert.Equal(t, map[string]string{
+		"apps/":          "",
+		"apps/test.toml": "image = 'test'",
+		"cluster.toml":   "[[node]]",
+	}, files)
+
+	t.Run("symlink", func(t *testing.T) {
+		require.NoError(t, os.Symlink("/etc/passwd", filepath.Join(dir, "passwd")))
+		_, err := buildTarball(dir)
+		assert.EqualError(t, err, "passwd is not a regular file")
+	})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jveski/recompose/internal/api"
+	"github.com/jveski/recompose/internal/inventory"
+	"github.com/urfave/cli/v2"
+)
+
+func renderCmd(c *cli.Context) error {
+	dir, err := getRepoDir(c)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := readNodes(dir, c.String("sha"))
+	if err != nil {
+		return err
+	}
+	node, err := resolveNode(nodes, c.String("node"))
+	if err != nil {
+		return err
+	}
+
+	return toml.NewEncoder(os.Stdout).Encode(node.Inventory)
+}
+
+func diffCmd(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return errors.New("two commit SHAs are required")
+	}
+
+	dir, err := getRepoDir(c)
+	if err != nil {
+		return err
+	}
+
+	before, err := readNodes(dir, c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	after, err := readNodes(dir, c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	printInventoryDiff(indexNodes(before), indexNodes(after), os.Stdout)
+	return nil
+}
+
+func getRepoDir(c *cli.Context) (string, error) {
+	if dir := c.String("dir"); dir != "" {
+		return dir, nil
+	}
+	return findRepoRoot(".")
+}
+
+// readNodes builds the inventory of every node just like the coordinator would.
+// The working tree is read when sha is empty, otherwise the directory's contents at the given commit.
+func readNodes(dir, sha string) ([]*inventory.Node, error) {
+	if sha != "" {
+		tmp, err := os.MkdirTemp("", "rectl-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmp)
+
+		full, err := gitArchive(dir, sha, tmp)
+		if err != nil {
+			return nil, err
+		}
+		dir, sha = tmp, full
+	} else if head, err := runGit(dir, "rev-parse", "--verify", "HEAD"); err == nil {
+		sha = head
+	}
+
+	cluster, err := inventory.ReadCluster(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading cluster.toml: %w", err)
+	}
+	return inventory.BuildNodes(dir, cluster, sha), nil
+}
+
+// gitArchive writes the contents of dir at the given commit into dst, returning the commit's full SHA.
+func gitArchive(dir, sha, dst string) (string, error) {
+	if strings.HasPrefix(sha, "-") {
+		return "", fmt.Errorf("invalid commit SHA %q", sha)
+	}
+	full, err := runGit(dir, "rev-parse", "--verify", "--quiet", sha+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("commit %s not found", sha)
+	}
+
+	// Archives are created from the root of the repo since git refuses to archive from subdirectories
+	root, err := runGit(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", err
+	}
+	prefix, err := runGit(dir, "rev-parse", "--show-prefix")
+	if err != nil {
+		return "", err
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("git", "archive", "--format=tar", full+":"+prefix)
+	cmd.Dir = root
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git error: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	tr := tar.NewReader(bytes.NewReader(out))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return full, nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		path := filepath.Join(dst, filepath.Clean("/"+hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeReg:
+			var content []byte
+			content, err = io.ReadAll(tr)
+			if err == nil {
+				err = os.WriteFile(path, content, 0644)
+			}
+		case tar.TypeSymlink:
+			// Links are kept as long as they point within the tree, as in the coordinator's checkout
+			rel, _ := filepath.Rel(dst, filepath.Join(filepath.Dir(path), hdr.Linkname))
+			if filepath.IsAbs(hdr.Linkname) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return "", fmt.Errorf("symlink %q points outside of the inventory", hdr.Name)
+			}
+			err = os.Symlink(hdr.Linkname, path)
+		default:
+			return "", fmt.Errorf("unsupported entry type for %q", hdr.Name)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+func runGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git error: %s", bytes.TrimSpace(out))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// resolveNode finds the node with the given name or fingerprint (prefix).
+func resolveNode(nodes []*inventory.Node, ref string) (*inventory.Node, error) {
+	if ref == "" {
+		return nil, errors.New("a node name or fingerprint is required")
+	}
+
+	var matches []*inventory.Node
+	for _, node := range nodes {
+		if node.Spec.Name == ref {
+			return node, nil
+		}
+		for _, fingerprint := range node.Spec.AllFingerprints() {
+			if strings.HasPrefix(fingerprint, ref) {
+				matches = append(matches, node)
+				break
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("node %q is not declared in cluster.toml", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("fingerprint prefix %q matches more than one node", ref)
+	}
+}
+
+func indexNodes(nodes []*inventory.Node) map[string]*api.NodeInventory {
+	index := map[string]*api.NodeInventory{}
+	for _, node := range nodes {
+		index[node.Spec.ID()] = node.Inventory
+	}
+	return index
+}
+
+// printInventoryDiff lists the containers added to or removed from each node, and the lines of each changed container spec.
+func printInventoryDiff(before, after map[string]*api.NodeInventory, w io.Writer) {
+	for _, change := range inventory.Diff(before, after) {
+		fmt.Fprintf(w, "node %s:\n", change.Node)
+		for _, name := range change.Added {
+			fmt.Fprintf(w, "  + %s\n", name)
+		}
+		for _, name := range change.Removed {
+			fmt.Fprintf(w, "  - %s\n", name)
+		}
+		for _, name := range change.Changed {
+			fmt.Fprintf(w, "  ~ %s\n", name)
+			for _, line := range diffLines(encodeContainer(before[change.Node], name), encodeContainer(after[change.Node], name)) {
+				fmt.Fprintf(w, "      %s\n", line)
+			}
+		}
+	}
+}
+
+func encodeContainer(inv *api.NodeInventory, name string) []string {
+	for _, container := range inv.Containers {
+		if container.Name != name {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		toml.NewEncoder(buf).Encode(container)
+		return strings.Split(strings.TrimSpace(buf.String()), "\n")
+	}
+	return nil
+}
+
+// diffLines returns the lines removed from a ("- ") and added in b ("+ ") using their longest common subsequence.
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := []string{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "- "+a[i])
+			i++
+		default:
+			lines = append(lines, "+ "+b[j])
+			j++
+		}
+	}
+	return lines
+}
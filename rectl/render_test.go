@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderAndDiff(t *testing.T) {
+	repo := t.TempDir()
+	dir := filepath.Join(repo, "cluster-a")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+
+	commit := func(files map[string]string) string {
+		t.Helper()
+		for name, content := range files {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		}
+		for _, args := range [][]string{{"add", "-A"}, {"-c", "user.name=test", "-c", "user.email=test@test", "commit", "-q", "-m", "test"}} {
+			_, err := runGit(repo, args...)
+			require.NoError(t, err)
+		}
+		sha, err := runGit(repo, "rev-parse", "HEAD")
+		require.NoError(t, err)
+		return sha
+	}
+
+	_, err := runGit(repo, "init", "-q")
+	require.NoError(t, err)
+	first := commit(map[string]string{
+		"cluster.toml": "[[node]]\nname = 'node-1'\nfingerprint = 'abcdef'\ncontainers = ['nginx.toml', 'redis.toml']\n",
+		"nginx.toml":   "image = 'nginx:1'\n",
+		"redis.toml":   "image = 'redis'\n",
+	})
+	second := commit(map[string]string{
+		"cluster.toml":  "[[node]]\nname = 'node-1'\nfingerprint = 'abcdef'\ncontainers = ['nginx.toml', 'postgres.toml']\n",
+		"nginx.toml":    "image = 'nginx:2'\n",
+		"postgres.toml": "image = 'postgres'\n",
+	})
+
+	t.Run("render", func(t *testing.T) {
+		nodes, err := readNodes(dir, first[:7])
+		require.NoError(t, err)
+		node, err := resolveNode(nodes, "abc")
+		require.NoError(t, err)
+		assert.Equal(t, first, node.Inventory.GitSHA)
+		require.Len(t, node.Inventory.Containers, 2)
+		assert.Equal(t, "nginx:1", node.Inventory.Containers[0].Image)
+
+		// The working tree
+		nodes, err = readNodes(dir, "")
+		require.NoError(t, err)
+		node, err = resolveNode(nodes, "node-1")
+		require.NoError(t, err)
+		assert.Equal(t, second, node.Inventory.GitSHA)
+		assert.Equal(t, "nginx:2", node.Inventory.Containers[0].Image)
+
+		_, err = resolveNode(nodes, "node-2")
+		assert.EqualError(t, err, `node "node-2" is not declared in cluster.toml`)
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		before, err := readNodes(dir, first)
+		require.NoError(t, err)
+		after, err := readNodes(dir, second)
+		require.NoError(t, err)
+
+		buf := &bytes.Buffer{}
+		printInventoryDiff(indexNodes(before), indexNodes(after), buf)
+		assert.Regexp(t, `^node node-1:
+  \+ postgres
+  - redis
+  ~ nginx
+      - hash = "v2-\w+"
+      - previousHashes = \["\w+"\]
+      - image = "nginx:1"
+      \+ hash = "v2-\w+"
+      \+ previousHashes = \["\w+"\]
+      \+ image = "nginx:2"
+$`, buf.String())
+	})
+
+	t.Run("symlinks", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join(dir, "redis.toml")))
+		require.NoError(t, os.Symlink("postgres.toml", filepath.Join(dir, "redis.toml")))
+		third := commit(map[string]string{
+			"cluster.toml": "[[node]]\nname = 'node-1'\nfingerprint = 'abcdef'\ncontainers = ['redis.toml']\n",
+		})
+		nodes, err := readNodes(dir, third)
+		require.NoError(t, err)
+		require.Len(t, nodes[0].Inventory.Containers, 1)
+		assert.Equal(t, "postgres", nodes[0].Inventory.Containers[0].Image)
+
+		// Links can't escape the tree
+		require.NoError(t, os.Remove(filepath.Join(dir, "redis.toml")))
+		require.NoError(t, os.Symlink("../outside.toml", filepath.Join(dir, "redis.toml")))
+		fourth := commit(nil)
+		_, err = readNodes(dir, fourth)
+		assert.EqualError(t, err, `symlink "redis.toml" points outside of the inventory`)
+	})
+}
+
+func TestDiffLines(t *testing.T) {
+	assert.Equal(t, []string{"- b", "+ c", "+ d"}, diffLines([]string{"a", "b"}, []string{"a", "c", "d"}))
+	assert.Equal(t, []string{}, diffLines([]string{"a"}, []string{"a"}))
+}
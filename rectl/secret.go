@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli/v2"
+)
+
+var armoredAgeRegex = regexp.MustCompile(`(?s)-----BEGIN AGE ENCRYPTED FILE-----\n.*?-----END AGE ENCRYPTED FILE-----`)
+
+func secretSetCmd(c *cli.Context) error {
+	file := c.Args().Get(0)
+	envvar := c.Args().Get(1)
+	if file == "" || envvar == "" {
+		return errors.New("a container file and env var name are required")
+	}
+
+	root, err := findRepoRoot(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+	recipients, err := readRecipients(root)
+	if err != nil {
+		return err
+	}
+
+	val, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("reading secret from stdin: %w", err)
+	}
+	// The coordinator trims a trailing newline from decrypted values (as written by `echo`)
+	val = append(bytes.TrimSuffix(val, []byte("\n")), '\n')
+
+	ciphertext, err := ageEncrypt(val, recipients)
+	if err != nil {
+		return err
+	}
+
+	doc, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	doc, err = setSecretCiphertext(doc, envvar, ciphertext)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, doc)
+}
+
+func secretRotateRecipientsCmd(c *cli.Context) error {
+	root := c.String("dir")
+	if root == "" {
+		var err error
+		root, err = findRepoRoot(".")
+		if err != nil {
+			return err
+		}
+	}
+
+	recipients, err := readRecipients(root)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || filepath.Ext(path) != ".toml" {
+			return nil
+		}
+
+		doc, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var n int
+		doc, err = replaceAllFunc(armoredAgeRegex, doc, func(armor []byte) ([]byte, error) {
+			plaintext, err := ageDecrypt(armor, c.String("identity"))
+			if err != nil {
+				return nil, err
+			}
+			n++
+			ciphertext, err := ageEncrypt(plaintext, recipients)
+			return []byte(ciphertext), err
+		})
+		if err != nil {
+			return fmt.Errorf("rotating secrets in %q: %w", path, err)
+		}
+		if n == 0 {
+			return nil
+		}
+
+		if err := writeFileAtomic(path, doc); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "re-encrypted %d secret(s) in %s\n", n, path)
+		return nil
+	})
+}
+
+// findRepoRoot returns the closest parent directory of dir that contains a cluster.toml.
+func findRepoRoot(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "cluster.toml")); err == nil {
+			return dir, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("cluster.toml not found in any parent directory")
+		}
+		dir = parent
+	}
+}
+
+func readRecipients(root string) ([]string, error) {
+	cluster := &struct {
+		Recipients []string `toml:"recipients"`
+	}{}
+	if _, err := toml.DecodeFile(filepath.Join(root, "cluster.toml"), cluster); err != nil {
+		return nil, fmt.Errorf("reading cluster.toml: %w", err)
+	}
+	if len(cluster.Recipients) == 0 {
+		return nil, errors.New("no secret recipients are declared in cluster.toml")
+	}
+	return cluster.Recipients, nil
+}
+
+func ageEncrypt(plaintext []byte, recipients []string) (string, error) {
+	args := []string{"--encrypt", "--armor"}
+	for _, r := range recipients {
+		args = append(args, "--recipient="+r)
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("age", args...)
+	cmd.Stdin = bytes.NewReader(plaintext)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("encrypting secret: %s", stderr)
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func ageDecrypt(ciphertext []byte, identity string) ([]byte, error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("age", "--decrypt", "--identity="+identity)
+	cmd.Stdin = bytes.NewReader(ciphertext)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("decrypting secret: %s", stderr)
+	}
+	return out, nil
+}
+
+func replaceAllFunc(re *regexp.Regexp, src []byte, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	var err error
+	out := re.ReplaceAllFunc(src, func(match []byte) []byte {
+		if err != nil {
+			return match
+		}
+		var repl []byte
+		repl, err = fn(match)
+		return repl
+	})
+	return out, err
+}
+
+// setSecretCiphertext replaces the ciphertext of the [[ secret ]] block with the given env var,
+// or appends a new block if one doesn't exist. The rest of the document is left untouched.
+func setSecretCiphertext(doc []byte, envvar, ciphertext string) ([]byte, error) {
+	lines := strings.Split(string(doc), "\n")
+	value := "ciphertext = \"\"\"\n" + ciphertext + "\n\"\"\""
+
+	for _, block := range scanTomlBlocks(lines) {
+		if block.Header != "[[secret]]" {
+			continue
+		}
+
+		keys := block.Keys(lines)
+		if keys["envvar"] == nil || tomlStringValue(lines[keys["envvar"][0]]) != envvar {
+			continue
+		}
+		if keys["name"] != nil {
+			return nil, fmt.Errorf("secret %q references a shared secret - set it in cluster.toml instead", envvar)
+		}
+
+		span := keys["ciphertext"]
+		if span == nil {
+			// Insert right after the envvar key
+			span = []int{keys["envvar"][1] + 1, keys["envvar"][1]}
+		}
+
+		out := append([]string{}, lines[:span[0]]...)
+		out = append(out, value)
+		out = append(out, lines[span[1]+1:]...)
+		return []byte(strings.Join(out, "\n")), nil
+	}
+
+	out := strings.TrimRight(string(doc), "\n")
+	out += fmt.Sprintf("\n\n[[ secret ]]\nenvvar = %q\n\n%s\n", envvar, value)
+	return []byte(out), nil
+}
+
+type tomlBlock struct {
+	Header     string // normalized i.e. [[secret]]
+	Start, End int    // line indices (exclusive of the header line)
+}
+
+// Keys returns the first and last line of each key's value within the block.
+func (b *tomlBlock) Keys(lines []string) map[string][]int {
+	keys := map[string][]int{}
+	var (
+		current   string
+		delimiter string
+	)
+	for i := b.Start; i < b.End; i++ {
+		line := lines[i]
+		if delimiter == "" {
+			key, val, ok := strings.Cut(line, "=")
+			if !ok || strings.HasPrefix(strings.TrimSpace(line), "#") {
+				continue
+			}
+			current = strings.TrimSpace(key)
+			keys[current] = []int{i, i}
+			delimiter = openMultilineDelimiter(val)
+			continue
+		}
+
+		keys[current][1] = i
+		if strings.Contains(line, delimiter) {
+			delimiter = ""
+		}
+	}
+	return keys
+}
+
+// scanTomlBlocks finds table headers in a TOML document while skipping over multi-line strings.
+func scanTomlBlocks(lines []string) []*tomlBlock {
+	blocks := []*tomlBlock{}
+	var delimiter string
+	for i, line := range lines {
+		if delimiter != "" {
+			if strings.Contains(line, delimiter) {
+				delimiter = ""
+			}
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			if len(blocks) > 0 {
+				blocks[len(blocks)-1].End = i
+			}
+			blocks = append(blocks, &tomlBlock{Header: strings.ReplaceAll(trimmed, " ", ""), Start: i + 1, End: len(lines)})
+			continue
+		}
+
+		if _, val, ok := strings.Cut(line, "="); ok && !strings.HasPrefix(trimmed, "#") {
+			delimiter = openMultilineDelimiter(val)
+		}
+	}
+	return blocks
+}
+
+// openMultilineDelimiter returns the delimiter of a multi-line string that is opened but not closed by the given value.
+func openMultilineDelimiter(val string) string {
+	for _, delim := range []string{`"""`, `'''`} {
+		if strings.Count(val, delim)%2 == 1 {
+			return delim
+		}
+	}
+	return ""
+}
+
+func tomlStringValue(line string) string {
+	_, val, _ := strings.Cut(line, "=")
+	return strings.Trim(strings.TrimSpace(val), `"'`)
+}
+
+func writeFileAtomic(file string, buf []byte) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(file), ".rectl-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	if err := f.Chmod(info.Mode()); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
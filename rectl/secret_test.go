@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetSecretCiphertext(t *testing.T) {
+	doc := `image = "test-image"
+
+[[ secret ]]
+envvar = "FOO"
+ciphertext = """
+old-foo
+"""
+
+[[ file ]]
+path = "/test"
+content = """
+[[ secret ]]
+envvar = "BAR"
+"""
+
+[[ secret ]]
+# a comment
+envvar = "BAZ"
+`
+
+	t.Run("replace", func(t *testing.T) {
+		actual, err := setSecretCiphertext([]byte(doc), "FOO", "new-foo")
+		require.NoError(t, err)
+		assert.Contains(t, string(actual), "envvar = \"FOO\"\nciphertext = \"\"\"\nnew-foo\n\"\"\"\n\n[[ file ]]")
+		assert.NotContains(t, string(actual), "old-foo")
+	})
+
+	t.Run("insert into existing block", func(t *testing.T) {
+		actual, err := setSecretCiphertext([]byte(doc), "BAZ", "new-baz")
+		require.NoError(t, err)
+		assert.Contains(t, string(actual), "# a comment\nenvvar = \"BAZ\"\nciphertext = \"\"\"\nnew-baz\n\"\"\"\n")
+	})
+
+	t.Run("append", func(t *testing.T) {
+		actual, err := setSecretCiphertext([]byte(doc), "BAR", "new-bar")
+		require.NoError(t, err)
+		assert.Equal(t, doc+"\n[[ secret ]]\nenvvar = \"BAR\"\n\nciphertext = \"\"\"\nnew-bar\n\"\"\"\n", string(actual))
+	})
+
+	t.Run("shared secret", func(t *testing.T) {
+		_, err := setSecretCiphertext([]byte("[[ secret ]]\nenvvar = \"FOO\"\nname = \"shared\"\n"), "FOO", "new-foo")
+		assert.EqualError(t, err, `secret "FOO" references a shared secret - set it in cluster.toml instead`)
+	})
+}
@@ -7,9 +7,12 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 
+	"github.com/BurntSushi/toml"
+	"github.com/jveski/recompose/internal/api"
 	"github.com/urfave/cli/v2"
 )
 
@@ -19,6 +22,11 @@ func statusCmd(c *cli.Context) error {
 		return err
 	}
 
+	// Older coordinators don't report sync status, so errors getting it aren't fatal
+	if status, err := getSyncStatus(c, cc); err == nil {
+		printSyncWarning(status, os.Stderr)
+	}
+
 	cluster, err := getClusterStatus(c, cc)
 	if err != nil {
 		return err
@@ -31,7 +39,7 @@ func statusCmd(c *cli.Context) error {
 
 func printClusterStatus(cluster [][]string, w io.Writer) {
 	tr := tabwriter.NewWriter(w, 6, 6, 4, ' ', 0)
-	fmt.Fprintf(tr, "NAME\tSTATE\tCREATED\tSTARTED\tNODE\tREASON\n")
+	fmt.Fprintf(tr, "NAME\tSTATE\tIMAGE\tCREATED\tSTARTED\tNODE\tREASON\n")
 	for _, row := range cluster {
 		if len(row) < 6 {
 			continue
@@ -40,11 +48,32 @@ func printClusterStatus(cluster [][]string, w io.Writer) {
 		if row[2] != "" {
 			reason = fmt.Sprintf("%q", row[2])
 		}
-		fmt.Fprintf(tr, "%s\t%s\t%s\t%s\t%s\t%s\n", row[0], row[1], transformTime(row[3]), transformTime(row[4]), row[5][:6], reason)
+		image := ""
+		if len(row) > 6 { // older agents don't report the image
+			image = shortenDigest(row[5])
+		}
+		fmt.Fprintf(tr, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", row[0], row[1], image, transformTime(row[3]), transformTime(row[4]), shortenNode(row[len(row)-1]), reason)
 	}
 	tr.Flush()
 }
 
+// shortenNode truncates node fingerprints while leaving node names intact.
+func shortenNode(node string) string {
+	if len(node) <= 6 || strings.Trim(node, "0123456789abcdef") != "" {
+		return node
+	}
+	return node[:6]
+}
+
+// shortenDigest truncates the digest of pinned images i.e. nginx@sha256:0123456789ab.
+func shortenDigest(image string) string {
+	name, digest, ok := strings.Cut(image, "@sha256:")
+	if !ok || len(digest) <= 12 {
+		return image
+	}
+	return name + "@sha256:" + digest[:12]
+}
+
 func getClusterStatus(c *cli.Context, cc *appContext) ([][]string, error) {
 	resp, err := cc.Client.GET(c.Context, cc.BaseURL+"/status")
 	if err != nil {
@@ -59,6 +88,28 @@ func getClusterStatus(c *cli.Context, cc *appContext) ([][]string, error) {
 	return csv.NewReader(resp.Body).ReadAll()
 }
 
+func getSyncStatus(c *cli.Context, cc *appContext) (*api.SyncStatus, error) {
+	resp, err := cc.Client.GET(c.Context, cc.BaseURL+"/sync")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	status := &api.SyncStatus{}
+	_, err = toml.NewDecoder(resp.Body).Decode(status)
+	return status, err
+}
+
+func printSyncWarning(status *api.SyncStatus, w io.Writer) {
+	if status.Pinned != "" {
+		fmt.Fprintf(w, "PINNED: the coordinator is deploying commit %s regardless of newer commits - run `rectl unpin` to resume\n", status.Pinned)
+	}
+	if status.Error == "" {
+		return
+	}
+	fmt.Fprintf(w, "warning: the coordinator failed to sync the inventory %s ago and is still serving version %s: %s\n", durationToString(time.Since(status.Time)), status.Version, status.Error)
+}
+
 func transformTime(unix string) string {
 	i, err := strconv.ParseInt(unix, 10, 0)
 	if err != nil || i == 0 {
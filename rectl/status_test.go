@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jveski/recompose/internal/api"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -16,14 +17,29 @@ func TestPrintClusterStatus(t *testing.T) {
 	}
 
 	cluster := [][]string{
-		{"test-name-1", "TestState", "test reason", mktime(0), mktime(-time.Second * 2), "111111111111111111111"},
-		{"test-name-2", "TestState", "", mktime(0), mktime(-time.Minute * 2), "111111111111111111111"},
+		{"test-name-1", "TestState", "test reason", mktime(0), mktime(-time.Second * 2), "nginx@sha256:0123456789abcdef", "111111111111111111111"},
+		{"test-name-2", "TestState", "", mktime(0), mktime(-time.Minute * 2), "nginx:latest", "111111111111111111111"},
 		{"test-name-3", "", "", mktime(0), mktime(-time.Hour * 2), "111111111111111111111"},
 		{"test-name-4", "", "test reason", mktime(0), mktime(-time.Hour * 24 * 2), "111111111111111111111"},
+		{"test-name-5", "", "", mktime(0), mktime(-time.Hour * 2), "nginx:latest", "web1"},
+		{"test-name-6", "", "", mktime(0), mktime(-time.Hour * 2), "nginx:latest", "web-frontend"},
 	}
 
 	buf := &bytes.Buffer{}
 	printClusterStatus(cluster, buf)
 
-	assert.Equal(t, "NAME           STATE        CREATED    STARTED    NODE      REASON\ntest-name-1    TestState    0s         2s         111111    \"test reason\"\ntest-name-2    TestState    0s         2m         111111    \ntest-name-3                 0s         2h         111111    \ntest-name-4                 0s         2d         111111    \"test reason\"\n", buf.String())
+	assert.Equal(t, "NAME           STATE        IMAGE                        CREATED    STARTED    NODE            REASON\ntest-name-1    TestState    nginx@sha256:0123456789ab    0s         2s         111111          \"test reason\"\ntest-name-2    TestState    nginx:latest                 0s         2m         111111          \ntest-name-3                                              0s         2h         111111          \ntest-name-4                                              0s         2d         111111          \"test reason\"\ntest-name-5                 nginx:latest                 0s         2h         web1            \ntest-name-6                 nginx:latest                 0s         2h         web-frontend    \n", buf.String())
+}
+
+func TestPrintSyncWarning(t *testing.T) {
+	buf := &bytes.Buffer{}
+	printSyncWarning(&api.SyncStatus{Version: "test-sha", Time: time.Now()}, buf)
+	assert.Empty(t, buf.String())
+
+	printSyncWarning(&api.SyncStatus{Version: "test-sha", Time: time.Now().Add(-time.Minute * 2), Error: "test error"}, buf)
+	assert.Equal(t, "warning: the coordinator failed to sync the inventory 2m ago and is still serving version test-sha: test error\n", buf.String())
+
+	buf.Reset()
+	printSyncWarning(&api.SyncStatus{Version: "test-sha", Time: time.Now(), Pinned: "test-sha"}, buf)
+	assert.Equal(t, "PINNED: the coordinator is deploying commit test-sha regardless of newer commits - run `rectl unpin` to resume\n", buf.String())
 }